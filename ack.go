@@ -0,0 +1,40 @@
+package kratos
+
+import (
+	"net/http"
+
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// defaultAck is the ack of received when there is no AckBuilder
+func defaultAck(received wrp.Message) wrp.Message {
+	status := int64(http.StatusAccepted)
+	return wrp.Message{
+		Type:        wrp.SimpleRequestResponseMessageType,
+		Source:      received.Destination,
+		Destination: received.Source,
+		Status:      &status,
+	}
+}
+
+// autoAck sends the ack of msg when AutoAck is set and msg is a request. It
+// is written ahead of the normal messages waiting, a failure is only logged
+// since the handlers still get msg.
+func (c *client) autoAck(msg wrp.Message) {
+	if !c.factory.AutoAck || msg.TransactionUUID == "" || !isResponseType(msg.Type) {
+		return
+	}
+
+	build := c.factory.AckBuilder
+	if build == nil {
+		build = defaultAck
+	}
+
+	ack := build(msg)
+	ack.TransactionUUID = msg.TransactionUUID
+	if err := c.SendPriority(PriorityHigh, ack); err != nil {
+		logging.Error(c).Log(logging.MessageKey(), "Failed to send ack", "transactionUUID", msg.TransactionUUID,
+			logging.ErrorKey(), err)
+	}
+}
@@ -0,0 +1,89 @@
+package kratos
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type ackCheckHandler struct {
+	sent     *[]wrp.Message
+	acksSeen []int
+}
+
+func (h *ackCheckHandler) HandleMessage(interface{}) {
+	h.acksSeen = append(h.acksSeen, len(*h.sent))
+}
+
+// test that requests are acked before the handlers get them, and only when
+// AutoAck is set
+func TestAutoAck(t *testing.T) {
+	request := wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          "dns:talaria",
+		Destination:     "mac:ffffff112233/config",
+		TransactionUUID: "emu:unique",
+	}
+
+	tests := []struct {
+		description string
+		autoAck     bool
+		builder     func(wrp.Message) wrp.Message
+		msg         wrp.Message
+		expected    []wrp.Message
+	}{
+		{"disabled", false, nil, request, nil},
+		{"default", true, nil, request, []wrp.Message{{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			Source:          "mac:ffffff112233/config",
+			Destination:     "dns:talaria",
+			TransactionUUID: "emu:unique",
+			Status:          func() *int64 { s := int64(202); return &s }(),
+		}}},
+		{"builder", true, func(received wrp.Message) wrp.Message {
+			return wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "event:ack/" + received.Source}
+		}, request, []wrp.Message{{
+			Type:            wrp.SimpleEventMessageType,
+			Destination:     "event:ack/dns:talaria",
+			TransactionUUID: "emu:unique",
+		}}},
+		{"event", true, nil, wrp.Message{Type: wrp.SimpleEventMessageType, Destination: "mac:ffffff112233/config"}, nil},
+		{"no transaction uuid", true, nil, wrp.Message{Type: wrp.SimpleRequestResponseMessageType, Destination: "mac:ffffff112233/config"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var sent []wrp.Message
+			fakeConn := &mockConnection{}
+			fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Run(func(args mock.Arguments) {
+				var msg wrp.Message
+				assert.Nil(wrp.NewDecoderBytes(args.Get(1).([]byte), wrp.Msgpack).Decode(&msg))
+				sent = append(sent, msg)
+			})
+
+			handler := &ackCheckHandler{sent: &sent}
+			testClient := &client{
+				deviceID:   "mac:ffffff112233",
+				connection: fakeConn,
+				handlers: []HandlerRegistry{
+					{HandlerKey: "/config", keyMatch: regexp.MustCompile("/config"), Handler: handler},
+				},
+				factory: ClientFactory{AutoAck: tc.autoAck, AckBuilder: tc.builder},
+				Logger:  logging.New(nil),
+			}
+
+			testClient.dispatch(tc.msg, nil)
+			assert.Equal(tc.expected, sent)
+
+			// the ack was written by the time the handler ran
+			assert.Equal([]int{len(tc.expected)}, handler.acksSeen)
+		})
+	}
+}
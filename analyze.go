@@ -0,0 +1,133 @@
+package kratos
+
+import (
+	"fmt"
+
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// ConflictKind tells how two or more handlers interfere with each other
+type ConflictKind int
+
+const (
+	// ConflictDuplicate is the same HandlerKey registered more than once.
+	ConflictDuplicate ConflictKind = iota
+
+	// ConflictCatchAll is a HandlerKey matching every destination, like ".*",
+	// which gets every message the other handlers get.
+	ConflictCatchAll
+
+	// ConflictOverlap is two HandlerKeys matching some of the same
+	// destinations.
+	ConflictOverlap
+)
+
+// HandlerConflict describes handlers whose HandlerKeys match the same
+// messages, which is easy to miss when a broad pattern ends up handling
+// messages meant for a narrower one
+type HandlerConflict struct {
+	Kind ConflictKind
+
+	// Keys are the HandlerKeys involved, in the order the handlers were
+	// registered.
+	Keys []string
+
+	// Explanation is a human readable description of the conflict.
+	Explanation string
+}
+
+// AnalyzeHandlers looks for HandlerKeys that match the same destinations.
+// Overlaps are detected on the literal part of the patterns, so it may miss
+// some between complex regular expressions. Handlers routed on headers alone
+// or with a SourceKey aren't analyzed.
+func (c *client) AnalyzeHandlers() []HandlerConflict {
+	var conflicts []HandlerConflict
+
+	handlers := c.registeredHandlers()
+	for i := range handlers {
+		a := handlers[i]
+		if a.keyMatch == nil || a.sourceRegex != nil {
+			continue
+		}
+
+		// an unanchored pattern matching the empty string matches every string
+		if a.keyMatch.MatchString("") {
+			conflicts = append(conflicts, HandlerConflict{
+				Kind:        ConflictCatchAll,
+				Keys:        []string{a.HandlerKey},
+				Explanation: fmt.Sprintf("%q matches every destination, so it also gets the messages of every other handler", a.HandlerKey),
+			})
+			continue
+		}
+
+		for j := i + 1; j < len(handlers); j++ {
+			b := handlers[j]
+			if b.keyMatch == nil || b.sourceRegex != nil || b.keyMatch.MatchString("") {
+				continue
+			}
+
+			if a.HandlerKey == b.HandlerKey {
+				conflicts = append(conflicts, HandlerConflict{
+					Kind:        ConflictDuplicate,
+					Keys:        []string{a.HandlerKey, b.HandlerKey},
+					Explanation: fmt.Sprintf("%q is registered more than once, every one of its handlers gets the same messages", a.HandlerKey),
+				})
+				continue
+			}
+
+			if destination, ok := overlap(a, b); ok {
+				conflicts = append(conflicts, HandlerConflict{
+					Kind:        ConflictOverlap,
+					Keys:        []string{a.HandlerKey, b.HandlerKey},
+					Explanation: fmt.Sprintf("%q and %q both match %q", a.HandlerKey, b.HandlerKey, destination),
+				})
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// overlap finds a destination matched by both handlers among the literal
+// prefixes of their patterns
+func overlap(a, b HandlerRegistry) (string, bool) {
+	for _, candidate := range []HandlerRegistry{a, b} {
+		prefix, _ := candidate.keyMatch.LiteralPrefix()
+		if prefix != "" && a.keyMatch.MatchString(prefix) && b.keyMatch.MatchString(prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// logHandlerConflicts warns about the conflicts AnalyzeHandlers finds
+func (c *client) logHandlerConflicts() {
+	for _, conflict := range c.AnalyzeHandlers() {
+		if conflict.Kind == ConflictDuplicate {
+			// already logged, or refused, while the handlers were compiled
+			continue
+		}
+		logging.Warn(c).Log(logging.MessageKey(), "Handlers match the same messages", "handlerKeys", conflict.Keys,
+			"conflict", conflict.Explanation)
+	}
+}
+
+// WouldMatch returns the HandlerKeys of the handlers a message sent to
+// destination would be given to, in the order they would be called, or the
+// "<default>" key of the DefaultHandler when none would. Handlers also routed
+// on the source or headers of messages are reported on their HandlerKey alone.
+// Nothing is dispatched.
+func (c *client) WouldMatch(destination string) []string {
+	var keys []string
+	handlers := c.registeredHandlers()
+	for i := range handlers {
+		if handlers[i].keyMatch != nil && handlers[i].keyMatch.MatchString(destination) {
+			keys = append(keys, handlers[i].HandlerKey)
+		}
+	}
+
+	if len(keys) == 0 && c.factory.DefaultHandler != nil {
+		keys = append(keys, defaultHandlerKey)
+	}
+	return keys
+}
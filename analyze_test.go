@@ -0,0 +1,66 @@
+package kratos
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := func(key string) HandlerRegistry {
+		return HandlerRegistry{HandlerKey: key, keyMatch: regexp.MustCompile(key)}
+	}
+
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			registry("/config"),
+			registry(".*"),
+			registry("/config/wifi"),
+			registry("/firmware"),
+			registry("/firmware"),
+			registry("^/status$"),
+			{HandlerKey: "", HeaderMatch: HasHeader("control")},
+		},
+	}
+
+	conflicts := testClient.AnalyzeHandlers()
+	if assert.Len(conflicts, 3) {
+		assert.Equal(ConflictOverlap, conflicts[0].Kind)
+		assert.Equal([]string{"/config", "/config/wifi"}, conflicts[0].Keys)
+		assert.Contains(conflicts[0].Explanation, `"/config/wifi"`)
+
+		assert.Equal(ConflictCatchAll, conflicts[1].Kind)
+		assert.Equal([]string{".*"}, conflicts[1].Keys)
+
+		assert.Equal(ConflictDuplicate, conflicts[2].Kind)
+		assert.Equal([]string{"/firmware", "/firmware"}, conflicts[2].Keys)
+	}
+
+	assert.Empty((&client{handlers: []HandlerRegistry{registry("/a"), registry("/b")}}).AnalyzeHandlers())
+}
+
+func TestWouldMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := func(key string) HandlerRegistry {
+		return HandlerRegistry{HandlerKey: key, keyMatch: regexp.MustCompile(key)}
+	}
+
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			registry("/config"),
+			registry("/config/wifi"),
+			{HandlerKey: "", HeaderMatch: HasHeader("control")},
+		},
+	}
+
+	assert.Equal([]string{"/config", "/config/wifi"}, testClient.WouldMatch("mac:ffffff112233/config/wifi"))
+	assert.Equal([]string{"/config"}, testClient.WouldMatch("mac:ffffff112233/config"))
+	assert.Empty(testClient.WouldMatch("mac:ffffff112233/firmware"))
+
+	testClient.factory.DefaultHandler = &myReadHandler{}
+	assert.Equal([]string{defaultHandlerKey}, testClient.WouldMatch("mac:ffffff112233/firmware"))
+}
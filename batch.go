@@ -0,0 +1,116 @@
+package kratos
+
+import (
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// inbound is a whole message read off the connection, waiting to be processed
+type inbound struct {
+	frameType int
+	raw       []byte
+}
+
+// readBatches is the read loop used when ReadBatchSize is set. A goroutine
+// reads the messages off the connection, up to size of them ahead of the
+// handlers, while this one takes all those already waiting at once and
+// processes them in a row.
+func (c *client) readBatches(connection websocketConnection, size int, decoder *wrp.Decoder) error {
+	messages := make(chan inbound, size)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var readErr error
+	fail := func(err error) {
+		readErr = err
+		if owner := c.owner(); owner != nil {
+			owner.handleReadError(connection, err)
+		}
+	}
+
+	c.goroutine(func() {
+		defer close(messages)
+		for {
+			frameType, serverMessage, err := connection.NextReader()
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			raw, err := ioutil.ReadAll(serverMessage)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			if owner := c.owner(); owner != nil && owner.isDraining() {
+				continue
+			}
+
+			atomic.AddInt32(&c.unprocessed, 1)
+			select {
+			case messages <- inbound{frameType: frameType, raw: raw}:
+			case <-stop:
+				atomic.AddInt32(&c.unprocessed, -1)
+				return
+			}
+		}
+	})
+
+	batch := make([]inbound, 0, size)
+	processed := 0
+
+	// when the loop ends early, the rest of the batch and whatever is still
+	// queued behind it won't be processed anymore
+	defer func() {
+		atomic.AddInt32(&c.unprocessed, -int32(len(batch)-processed))
+		c.goroutine(func() {
+			for range messages {
+				atomic.AddInt32(&c.unprocessed, -1)
+			}
+		})
+	}()
+
+	for next := range messages {
+		batch = append(batch[:0], next)
+		processed = 0
+
+	drain:
+		for len(batch) < size {
+			select {
+			case next, ok := <-messages:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		// the messages belong to whichever client has the connection now
+		owner := c.owner()
+		if owner == nil {
+			// the connection was exported and then dropped
+			return nil
+		}
+
+		// the whole batch arrived by now
+		owner.markMessage()
+
+		for _, m := range batch {
+			atomic.AddInt32(&c.unprocessed, -1)
+			processed++
+			if err := owner.process(decoder, m.frameType, m.raw); err != nil {
+				// closing the connection, deferred by read, ends the reading
+				// goroutine if it isn't blocked on stop
+				return err
+			}
+		}
+	}
+
+	// messages is closed once readErr is set
+	return readErr
+}
@@ -0,0 +1,83 @@
+package kratos
+
+import (
+	"io"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+type countHandler struct {
+	count int
+}
+
+func (c *countHandler) HandleMessage(interface{}) {
+	c.count++
+}
+
+// test that every message read ahead is dispatched before the read loop ends
+func TestReadBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &countHandler{}
+	testClient := &client{
+		connection: &discardConnection{message: goodMsg, remaining: 100},
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		factory: ClientFactory{ReadBatchSize: 8},
+		Logger:  logging.New(nil),
+	}
+
+	assert.Equal(io.EOF, testClient.read())
+	assert.Equal(100, handler.count)
+}
+
+// test that the messages read ahead aren't left counted as unprocessed when
+// the read loop ends in the middle of a batch
+func TestReadBatchesEndEarly(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{
+		connection: &discardConnection{message: []byte("not msgpack"), remaining: 20},
+		factory:    ClientFactory{ReadBatchSize: 8},
+		shutdown:   make(chan struct{}),
+		Logger:     logging.New(nil),
+	}
+
+	// the read error once the connection runs out doesn't reconnect
+	close(testClient.shutdown)
+
+	assert.NotNil(testClient.read())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for testClient.GoroutineCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Zero(testClient.GoroutineCount())
+	assert.Zero(atomic.LoadInt32(&testClient.unprocessed))
+}
+
+func BenchmarkReadBatches(b *testing.B) {
+	testClient := &client{
+		connection: &discardConnection{message: goodMsg, remaining: b.N},
+		handlers: []HandlerRegistry{
+			{
+				HandlerKey: "/bar",
+				keyMatch:   regexp.MustCompile("/bar"),
+				Handler:    &myReadHandler{handlerCalled: true},
+			},
+		},
+		factory: ClientFactory{ReadBatchSize: 64},
+		Logger:  logging.New(nil),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	testClient.read()
+}
@@ -0,0 +1,63 @@
+package kratos
+
+import (
+	"sync"
+	"time"
+)
+
+// ReconnectBudget caps how many reconnect attempts are made within a rolling
+// window, on top of the backoff between two attempts, so that a device can't
+// keep reconnecting against a dead backend. Once the budget is spent the
+// client waits for CooldownAfterExhaustion, or Window when it is zero, before
+// trying again with a new budget.
+type ReconnectBudget struct {
+	// Max is the number of attempts allowed within Window. The budget is
+	// unlimited unless it is positive.
+	Max    int
+	Window time.Duration
+
+	CooldownAfterExhaustion time.Duration
+}
+
+// cooldown is how long to wait once the budget is spent
+func (b ReconnectBudget) cooldown() time.Duration {
+	if b.CooldownAfterExhaustion > 0 {
+		return b.CooldownAfterExhaustion
+	}
+	return b.Window
+}
+
+// reconnectBudget keeps track of the attempts counted against a
+// ReconnectBudget
+type reconnectBudget struct {
+	lock     sync.Mutex
+	attempts []time.Time
+}
+
+// take counts an attempt made at now against budget. When the budget is spent
+// the attempt must not be made, and the cooldown to wait is returned instead.
+func (r *reconnectBudget) take(budget ReconnectBudget, now time.Time) time.Duration {
+	if budget.Max <= 0 {
+		return 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	recent := r.attempts[:0]
+	for _, attempt := range r.attempts {
+		if now.Sub(attempt) < budget.Window {
+			recent = append(recent, attempt)
+		}
+	}
+	r.attempts = recent
+
+	if len(r.attempts) >= budget.Max {
+		// the budget starts over after the cooldown
+		r.attempts = r.attempts[:0]
+		return budget.cooldown()
+	}
+
+	r.attempts = append(r.attempts, now)
+	return 0
+}
@@ -0,0 +1,34 @@
+package kratos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	budget := ReconnectBudget{Max: 2, Window: time.Minute, CooldownAfterExhaustion: time.Hour}
+	var tracked reconnectBudget
+
+	start := time.Now()
+	assert.Equal(time.Duration(0), tracked.take(budget, start))
+	assert.Equal(time.Duration(0), tracked.take(budget, start.Add(10*time.Second)))
+	assert.Equal(time.Hour, tracked.take(budget, start.Add(20*time.Second)))
+
+	// a new budget after the cooldown
+	later := start.Add(time.Hour + 20*time.Second)
+	assert.Equal(time.Duration(0), tracked.take(budget, later))
+	assert.Equal(time.Duration(0), tracked.take(budget, later.Add(time.Second)))
+
+	// attempts older than the window no longer count
+	assert.Equal(time.Duration(0), tracked.take(budget, later.Add(time.Minute+time.Second)))
+
+	// the window is the cooldown by default, and no limit is the default
+	budget.CooldownAfterExhaustion = 0
+	assert.Equal(time.Duration(0), tracked.take(budget, later.Add(time.Minute+2*time.Second)))
+	assert.Equal(time.Minute, tracked.take(budget, later.Add(time.Minute+3*time.Second)))
+	assert.Equal(time.Duration(0), tracked.take(ReconnectBudget{}, later))
+}
@@ -0,0 +1,97 @@
+package kratos
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// MessageBuilder builds a WRP message coming from a client. Its source is the
+// client's device id and it gets a fresh transaction uuid, so neither has to be
+// filled in by hand at every call site.
+type MessageBuilder struct {
+	message wrp.Message
+	version WRPVersion
+}
+
+// NewMessage starts a SimpleRequestResponse message from this client
+func (c *client) NewMessage() *MessageBuilder {
+	return &MessageBuilder{
+		message: wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			Source:          c.deviceID,
+			TransactionUUID: newTransactionUUID(),
+		},
+		version: c.factory.wrpVersion(),
+	}
+}
+
+// Type changes the type of the message, a SimpleEventMessageType message
+// doesn't keep a transaction uuid
+func (b *MessageBuilder) Type(messageType wrp.MessageType) *MessageBuilder {
+	b.message.Type = messageType
+	if messageType == wrp.SimpleEventMessageType {
+		b.message.TransactionUUID = ""
+	}
+	return b
+}
+
+// To sets the destination of the message
+func (b *MessageBuilder) To(destination string) *MessageBuilder {
+	b.message.Destination = destination
+	return b
+}
+
+// Payload sets the payload of the message
+func (b *MessageBuilder) Payload(payload []byte) *MessageBuilder {
+	b.message.Payload = payload
+	return b
+}
+
+// ContentType sets the content type of the payload
+func (b *MessageBuilder) ContentType(contentType string) *MessageBuilder {
+	b.message.ContentType = contentType
+	return b
+}
+
+// Partner adds a partner id to the message, unless the client uses
+// WRPVersion1 which has no partner ids
+func (b *MessageBuilder) Partner(partnerID string) *MessageBuilder {
+	if b.version != WRPVersion1 {
+		b.message.PartnerIDs = append(b.message.PartnerIDs, partnerID)
+	}
+	return b
+}
+
+// Header adds a header to the message
+func (b *MessageBuilder) Header(header string) *MessageBuilder {
+	b.message.Headers = append(b.message.Headers, header)
+	return b
+}
+
+// TransactionUUID replaces the generated transaction uuid
+func (b *MessageBuilder) TransactionUUID(transactionUUID string) *MessageBuilder {
+	b.message.TransactionUUID = transactionUUID
+	return b
+}
+
+// Build returns the message, ready to be given to Send or SendWithResponse
+func (b *MessageBuilder) Build() wrp.Message {
+	message := b.message
+	message.PartnerIDs = append([]string(nil), b.message.PartnerIDs...)
+	message.Headers = append([]string(nil), b.message.Headers...)
+	return message
+}
+
+// newTransactionUUID returns a random version 4 uuid
+func newTransactionUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
@@ -0,0 +1,41 @@
+package kratos
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{deviceID: "mac:ffffff112233"}
+
+	builder := testClient.NewMessage().
+		To("dns:talaria.example.com/config").
+		Payload([]byte(`{"enabled":true}`)).
+		ContentType("application/json").
+		Partner("comcast")
+
+	message := builder.Build()
+	assert.Equal(wrp.SimpleRequestResponseMessageType, message.Type)
+	assert.Equal("mac:ffffff112233", message.Source)
+	assert.Equal("dns:talaria.example.com/config", message.Destination)
+	assert.Equal([]byte(`{"enabled":true}`), message.Payload)
+	assert.Equal("application/json", message.ContentType)
+	assert.Equal([]string{"comcast"}, message.PartnerIDs)
+	assert.Regexp(regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), message.TransactionUUID)
+
+	// building again doesn't share the partner ids with the first message
+	second := builder.Partner("other").Build()
+	assert.Equal([]string{"comcast"}, message.PartnerIDs)
+	assert.Equal([]string{"comcast", "other"}, second.PartnerIDs)
+
+	assert.NotEqual(message.TransactionUUID, testClient.NewMessage().Build().TransactionUUID)
+
+	event := testClient.NewMessage().Type(wrp.SimpleEventMessageType).To("event:online").Build()
+	assert.Equal(wrp.SimpleEventMessageType, event.Type)
+	assert.Empty(event.TransactionUUID)
+}
@@ -0,0 +1,118 @@
+package kratos
+
+import "time"
+
+// clockJumpThreshold is how far the wall clock may drift from the monotonic
+// clock between two checks before it's reported as a jump.
+const clockJumpThreshold = 5 * time.Second
+
+// clockWatch looks for wall clock jumps between successive observations, such
+// as when NTP first syncs on a device with a bad RTC.
+//
+// The client's deadlines and timers are all derived from time.Now() without
+// stripping its monotonic reading, so they aren't affected by such jumps. This
+// only makes them visible in the logs, to explain what else may misbehave.
+type clockWatch struct {
+	clock    clock
+	last     time.Time
+	lastWall time.Time
+}
+
+func newClockWatch(c clock) *clockWatch {
+	return &clockWatch{clock: c, last: c.Now(), lastWall: c.Wall()}
+}
+
+// observe returns how much the wall clock moved on its own since the last
+// observation, positive for a jump forward and negative for one backward, or
+// zero if it is within clockJumpThreshold
+func (w *clockWatch) observe() time.Duration {
+	now, wall := w.clock.Now(), w.clock.Wall()
+	jump := wall.Sub(w.lastWall) - now.Sub(w.last)
+	w.last, w.lastWall = now, wall
+
+	if jump < clockJumpThreshold && jump > -clockJumpThreshold {
+		return 0
+	}
+	return jump
+}
+
+// clock is where the client takes the time and its timers from, so that tests
+// can make time pass at will instead of sleeping. The read and write deadlines
+// of the connection are the exception, they always run on the real clock.
+type clock interface {
+	Now() time.Time
+
+	// Wall is the time on the wall clock alone, which unlike the monotonic
+	// reading of Now may jump
+	Wall() time.Time
+
+	NewTimer(d time.Duration) timer
+	NewTicker(d time.Duration) ticker
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is the part of a time.Timer the client uses
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// ticker is the part of a time.Ticker the client uses
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// clockOr returns c, or the real clock when c is nil
+func clockOr(c clock) clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+// realClock is the clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Wall() time.Time {
+	return time.Now().Round(0)
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// clock returns the clock of the client, the real one unless a test set
+// another
+func (c *client) clock() clock {
+	return clockOr(c.factory.clock)
+}
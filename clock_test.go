@@ -0,0 +1,281 @@
+package kratos
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+func TestClockWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	watch := newClockWatch(clock)
+
+	clock.Advance(time.Minute)
+	assert.Equal(time.Duration(0), watch.observe())
+
+	clock.Jump(time.Hour)
+	clock.Advance(time.Minute)
+	assert.Equal(time.Hour, watch.observe())
+
+	clock.Jump(-10 * time.Second)
+	assert.Equal(-10*time.Second, watch.observe())
+
+	// within the threshold
+	clock.Jump(clockJumpThreshold - time.Second)
+	assert.Equal(time.Duration(0), watch.observe())
+	assert.Equal(time.Duration(0), watch.observe())
+}
+
+// test that the ping handler reports a jump of the wall clock
+func TestCheckPingClockJump(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1), nil)
+	if !assert.Nil(err) {
+		return
+	}
+
+	clock := newFakeClock()
+	jumps := make(chan interface{}, 10)
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "jump" {
+				jumps <- keyvals[i+1]
+			}
+		}
+		return nil
+	})
+
+	testClient := &client{
+		Logger:  logging.New(nil),
+		factory: ClientFactory{clock: clock},
+	}
+
+	testPingHandler := &pingHandler{
+		conn:   conn,
+		stop:   make(chan bool),
+		done:   make(chan struct{}),
+		Logger: logger,
+	}
+
+	go testPingHandler.checkPing(testClient)
+	assert.Equal(pingPeriod, <-clock.created)
+
+	clock.Jump(-time.Hour)
+	clock.Advance(pingPeriod)
+	select {
+	case jump := <-jumps:
+		assert.Equal(-time.Hour, jump)
+	case <-time.After(3 * time.Second):
+		assert.Fail("the jump wasn't reported")
+	}
+
+	testPingHandler.stopPingHandler()
+	select {
+	case <-testPingHandler.done:
+	case <-time.After(3 * time.Second):
+		assert.Fail("the ping handler didn't stop")
+	}
+}
+
+// fakeClock is a clock whose time only passes with Advance. Every timer or
+// ticker made is announced on created with its duration. Its wall clock is
+// apart from the time the timers go by, moving on its own with Jump.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	skew    time.Duration
+	timers  []*fakeTimer
+	created chan time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Unix(1500000000, 0),
+		created: make(chan time.Duration, 100),
+	}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Wall() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now.Add(f.skew)
+}
+
+// Jump moves the wall clock by d, the timers staying put
+func (f *fakeClock) Jump(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.skew += d
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) timer {
+	return f.newTimer(d, 0, nil)
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{f.newTimer(d, d, nil)}
+}
+
+func (f *fakeClock) AfterFunc(d time.Duration, fn func()) timer {
+	return f.newTimer(d, 0, fn)
+}
+
+func (f *fakeClock) newTimer(d, period time.Duration, fn func()) *fakeTimer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: period, fn: fn}
+
+	f.lock.Lock()
+	f.timers = append(f.timers, t)
+	t.schedule(d)
+	f.lock.Unlock()
+
+	f.created <- d
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due meanwhile
+func (f *fakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+	for _, t := range f.timers {
+		t.fire()
+	}
+}
+
+// fakeTimer is a timer, or a ticker when it has a period, of a fakeClock.
+// When it has a fn, that is called in a goroutine of its own instead of
+// sending on c.
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time
+	active bool
+	period time.Duration
+	fn     func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.schedule(d)
+	return active
+}
+
+// schedule sets the timer off in d, the clock being locked
+func (t *fakeTimer) schedule(d time.Duration) {
+	t.at = t.clock.now.Add(d)
+	t.active = true
+	t.fire()
+}
+
+// fire sends on the timer if it is due, the clock being locked
+func (t *fakeTimer) fire() {
+	for t.active && !t.at.After(t.clock.now) {
+		if t.fn != nil {
+			go t.fn()
+		} else {
+			select {
+			case t.c <- t.clock.now:
+			default:
+			}
+		}
+
+		if t.period <= 0 {
+			t.active = false
+		} else {
+			t.at = t.at.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// test that the reconnect backoff only waits on the clock of the client
+func TestReconnectBackoffClock(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	dials := make(chan string, 10)
+	stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	close(stoppedPingHandler.done)
+
+	testClient := &client{
+		Logger:      logging.New(nil),
+		shutdown:    make(chan struct{}),
+		pingHandler: stoppedPingHandler,
+		headerInfo:  &clientHeader{deviceName: "mac:ffffff112233"},
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				dials <- addr
+				return nil, errors.New("unreachable")
+			},
+			clock: clock,
+		},
+	}
+
+	testClient.startReconnect(ReconnectServerClose, "1012", 0)
+
+	// the first attempt doesn't wait
+	assert.Equal(time.Duration(0), <-clock.created)
+	<-dials
+
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		assert.Equal(backoff, <-clock.created)
+
+		clock.Advance(backoff - time.Millisecond)
+		select {
+		case <-dials:
+			assert.Fail("dialed before the backoff was over")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clock.Advance(time.Millisecond)
+		select {
+		case <-dials:
+		case <-time.After(3 * time.Second):
+			assert.Fail("no dial once the backoff was over")
+		}
+	}
+
+	assert.Nil(testClient.Close())
+}
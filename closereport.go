@@ -0,0 +1,38 @@
+package kratos
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// CloseReport tells what was lost when a client was closed
+type CloseReport struct {
+	// UnprocessedInbound is the number of messages read off the connection
+	// ahead of the handlers, with ReadBatchSize or while dispatch was
+	// paused, that were never handed to them.
+	UnprocessedInbound int
+
+	// UnsentOutbound is the number of messages still waiting to be written.
+	UnsentOutbound int
+}
+
+// CloseWithReport is CloseCtx, also reporting the messages that were still
+// unprocessed or unsent once reading and writing stopped, so that the data
+// lost on shutdown can be accounted for. Losses are logged as well.
+func (c *client) CloseWithReport(ctx context.Context) (CloseReport, error) {
+	err := c.CloseCtx(ctx)
+
+	report := CloseReport{
+		UnprocessedInbound: int(atomic.LoadInt32(&c.unprocessed)),
+		UnsentOutbound:     c.QueueDepth(),
+	}
+
+	if report.UnprocessedInbound > 0 || report.UnsentOutbound > 0 {
+		logging.Warn(c).Log(logging.MessageKey(), "Closed with messages lost",
+			"unprocessedInbound", report.UnprocessedInbound, "unsentOutbound", report.UnsentOutbound)
+	}
+
+	return report, err
+}
@@ -0,0 +1,81 @@
+package kratos
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type startedHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *startedHandler) HandleMessage(interface{}) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+}
+
+// test that the messages read ahead but never handled and those waiting to be
+// written are reported
+func TestCloseWithReport(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &startedHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	connection := &exhaustingConnection{
+		discardConnection: discardConnection{message: goodMsg, remaining: 5},
+		exhausted:         make(chan struct{}),
+	}
+
+	testClient := &client{
+		connection: connection,
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		pingHandler: &pingHandler{stop: make(chan bool), done: make(chan struct{})},
+		factory:     ClientFactory{ReadBatchSize: 8},
+		shutdown:    make(chan struct{}),
+		Logger:      logging.New(nil),
+	}
+
+	// as if the ping handler had already closed the connection
+	close(testClient.pingHandler.done)
+
+	readDone := make(chan struct{})
+	go func() {
+		testClient.read()
+		close(readDone)
+	}()
+
+	<-connection.exhausted
+	<-handler.started
+
+	// a message waits for the writes ahead of it
+	testClient.sendQueue.acquire(PriorityNormal)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- testClient.Send(wrp.SimpleEvent{Destination: "event:test"})
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for testClient.QueueDepth() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	report, err := testClient.CloseWithReport(context.Background())
+	assert.Nil(err)
+	assert.Equal(CloseReport{UnprocessedInbound: 4, UnsentOutbound: 1}, report)
+
+	testClient.sendQueue.release()
+	<-sent
+	close(handler.release)
+	<-readDone
+}
@@ -0,0 +1,39 @@
+package kratos
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// ContextReadHandler can be implemented by a ReadHandler that wants a context
+// along with every message. HandleMessageCtx is then called instead of
+// HandleMessage, though RawReadHandler takes precedence when both are
+// implemented.
+type ContextReadHandler interface {
+	ReadHandler
+	HandleMessageCtx(ctx context.Context, msg interface{})
+}
+
+type loggerKey struct{}
+
+// LoggerFromContext returns the logger of the message given to a
+// ContextReadHandler, which carries its transaction uuid so that what the
+// handler logs can be correlated with it. ok is false for a context that
+// didn't come from the client.
+func LoggerFromContext(ctx context.Context) (logger log.Logger, ok bool) {
+	logger, ok = ctx.Value(loggerKey{}).(log.Logger)
+	return
+}
+
+// messageContext builds the context handed to a ContextReadHandler along with
+// msg
+func (c *client) messageContext(msg interface{}) context.Context {
+	logger := c.Logger
+	if wrpData, ok := msg.(wrp.Message); ok && wrpData.TransactionUUID != "" {
+		logger = log.With(logger, "transactionUUID", wrpData.TransactionUUID)
+	}
+
+	return context.WithValue(context.Background(), loggerKey{}, logger)
+}
@@ -0,0 +1,41 @@
+package kratos
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type ctxHandler struct {
+	keyvals []interface{}
+}
+
+func (h *ctxHandler) HandleMessage(interface{}) {}
+
+func (h *ctxHandler) HandleMessageCtx(ctx context.Context, msg interface{}) {
+	if logger, ok := LoggerFromContext(ctx); ok {
+		logger.Log("msg", "handled")
+	}
+}
+
+// test that a ContextReadHandler logs with the transaction uuid of its message
+func TestContextReadHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &ctxHandler{}
+	testClient := &client{
+		Logger: log.LoggerFunc(func(keyvals ...interface{}) error {
+			handler.keyvals = keyvals
+			return nil
+		}),
+	}
+
+	testClient.handle("/bar", handler, wrp.Message{TransactionUUID: "emu:unique"}, nil)
+	assert.Equal([]interface{}{"transactionUUID", "emu:unique", "msg", "handled"}, handler.keyvals)
+
+	_, ok := LoggerFromContext(context.Background())
+	assert.False(ok)
+}
@@ -0,0 +1,49 @@
+package kratos
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// CloseDrain closes the client like CloseCtx, except that the messages already
+// read off the connection, such as those read ahead with ReadBatchSize or
+// waiting on a handler's MaxConcurrency, are all handed to the handlers before
+// it returns. Messages arriving once it is called are dropped. Should ctx be
+// done first, the remaining messages may be lost and ctx.Err() is returned.
+func (c *client) CloseDrain(ctx context.Context) error {
+	atomic.StoreInt32(&c.draining, 1)
+
+	c.writeLock.Lock()
+	pingHandler := c.pingHandler
+	c.writeLock.Unlock()
+
+	if err := c.CloseCtx(ctx); err != nil {
+		return err
+	}
+
+	if pingHandler != nil {
+		select {
+		case <-pingHandler.readDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	handled := make(chan struct{})
+	go func() {
+		c.handling.Wait()
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isDraining tells whether CloseDrain was called, and new messages dropped
+func (c *client) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
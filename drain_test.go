@@ -0,0 +1,75 @@
+package kratos
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+type slowCountHandler struct {
+	countHandler
+}
+
+func (s *slowCountHandler) HandleMessage(msg interface{}) {
+	time.Sleep(time.Millisecond)
+	s.countHandler.HandleMessage(msg)
+}
+
+// exhaustingConnection tells when it has no message left
+type exhaustingConnection struct {
+	discardConnection
+	exhausted chan struct{}
+}
+
+func (e *exhaustingConnection) NextReader() (int, io.Reader, error) {
+	frameType, r, err := e.discardConnection.NextReader()
+	if err != nil {
+		close(e.exhausted)
+	}
+	return frameType, r, err
+}
+
+// test that the messages read ahead are all handled before CloseDrain returns
+func TestCloseDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &slowCountHandler{}
+	connection := &exhaustingConnection{
+		discardConnection: discardConnection{message: goodMsg, remaining: 20},
+		exhausted:         make(chan struct{}),
+	}
+
+	readDone := make(chan struct{})
+	testClient := &client{
+		connection: connection,
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		pingHandler: &pingHandler{
+			stop:     make(chan bool),
+			done:     make(chan struct{}),
+			readDone: readDone,
+		},
+		factory:  ClientFactory{ReadBatchSize: 64},
+		shutdown: make(chan struct{}),
+		Logger:   logging.New(nil),
+	}
+
+	// as if the ping handler had already closed the connection
+	close(testClient.pingHandler.done)
+
+	go func() {
+		testClient.read()
+		close(readDone)
+	}()
+
+	// every message is read ahead while the handler is still busy
+	<-connection.exhausted
+	assert.Nil(testClient.CloseDrain(context.Background()))
+	assert.Equal(20, handler.count)
+}
@@ -0,0 +1,85 @@
+package kratos
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// WeightedEndpoint is a discovery URL along with its share of the
+// connections, relative to the weights of the other DestinationEndpoints. An
+// endpoint with a weight of zero or less is only asked once all the others
+// have failed.
+type WeightedEndpoint struct {
+	URL    string
+	Weight int
+}
+
+// hasDiscovery tells whether there is anywhere to run discovery at
+func (f *ClientFactory) hasDiscovery() bool {
+	return f.DestinationURL != "" || len(f.DestinationEndpoints) > 0
+}
+
+// discoveryURLs lists the URLs discovery is tried at, in order
+func (f *ClientFactory) discoveryURLs() []string {
+	if len(f.DestinationEndpoints) == 0 {
+		return []string{f.DestinationURL}
+	}
+	return weightedOrder(f.DestinationEndpoints, rand.Intn)
+}
+
+// weightedOrder shuffles the URLs of endpoints so that the chance of each to
+// come before the others is its share of their weights. Those without a
+// weight are kept last, in the order given. intn returns a random number in
+// [0, n).
+func weightedOrder(endpoints []WeightedEndpoint, intn func(n int) int) []string {
+	var (
+		weighted   []WeightedEndpoint
+		unweighted []string
+		total      int
+	)
+
+	for _, endpoint := range endpoints {
+		if endpoint.Weight > 0 {
+			weighted = append(weighted, endpoint)
+			total += endpoint.Weight
+		} else {
+			unweighted = append(unweighted, endpoint.URL)
+		}
+	}
+
+	urls := make([]string, 0, len(endpoints))
+	for len(weighted) > 0 {
+		pick := intn(total)
+		i := 0
+		for ; pick >= weighted[i].Weight; i++ {
+			pick -= weighted[i].Weight
+		}
+
+		urls = append(urls, weighted[i].URL)
+		total -= weighted[i].Weight
+		weighted = append(weighted[:i], weighted[i+1:]...)
+	}
+
+	return append(urls, unweighted...)
+}
+
+// discoverAny runs discovery at each of the discovery URLs in turn until one
+// hands out a backend, returning the error of the last one otherwise
+func discoverAny(ctx context.Context, client http.Client, headerInfo *clientHeader, f *ClientFactory, logger log.Logger) (wsURL string, err error) {
+	urls := f.discoveryURLs()
+	for i, destinationURL := range urls {
+		wsURL, err = discover(ctx, client, destinationURL, headerInfo, f, logger)
+		if err == nil || ctx.Err() != nil || i == len(urls)-1 {
+			return
+		}
+
+		logging.Warn(logger).Log(logging.MessageKey(), "Discovery failed, trying the next endpoint",
+			"destinationURL", destinationURL, logging.ErrorKey(), err)
+	}
+
+	return
+}
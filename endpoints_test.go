@@ -0,0 +1,71 @@
+package kratos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+func TestWeightedOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints := []WeightedEndpoint{
+		{URL: "http://a.example.com", Weight: 3},
+		{URL: "http://fallback.example.com"},
+		{URL: "http://b.example.com", Weight: 1},
+	}
+
+	// the picks land on the last share of the weights
+	last := func(n int) int { return n - 1 }
+	assert.Equal([]string{"http://b.example.com", "http://a.example.com", "http://fallback.example.com"},
+		weightedOrder(endpoints, last))
+
+	first := func(int) int { return 0 }
+	assert.Equal([]string{"http://a.example.com", "http://b.example.com", "http://fallback.example.com"},
+		weightedOrder(endpoints, first))
+
+	assert.Equal([]string{"http://fabric.example.com"},
+		(&ClientFactory{DestinationURL: "http://fabric.example.com"}).discoveryURLs())
+}
+
+// test that discovery falls back to another endpoint when the one picked fails
+func TestDestinationEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
+
+	var failed int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
+
+	factory := &ClientFactory{
+		DeviceName:   "mac:ffffff112233",
+		ClientLogger: logging.New(nil),
+		DestinationEndpoints: []WeightedEndpoint{
+			{URL: broken.URL, Weight: 1},
+			{URL: petasos.URL},
+		},
+	}
+
+	testClient, err := factory.New()
+	assert.Nil(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&failed))
+	if testClient != nil {
+		testClient.Close()
+	}
+}
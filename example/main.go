@@ -6,7 +6,6 @@ import (
 
 	"github.com/xmidt-org/kratos"
 	"github.com/xmidt-org/webpa-common/logging"
-	"github.com/xmidt-org/wrp-go/wrp"
 )
 
 var (
@@ -69,23 +68,22 @@ func main() {
 		fmt.Println("Error making client: ", err)
 	}
 
-	optionalUUID := "IamOptional"
-	if err != nil {
-		fmt.Println("Error generating uuid: ", err)
-	}
-
-	// construct a client message for us to send to the server
-	myMessage := wrp.SimpleRequestResponse{
-		Source:          "mac:ffffff112233/emu",
-		Destination:     "event:device-status/bla/bla",
-		TransactionUUID: "emu:" + optionalUUID,
-		Payload:         []byte("the payload has reached the checkpoint"),
-	}
+	// construct a client message for us to send to the server, the source and
+	// transaction uuid come from the client
+	myMessage := client.NewMessage().
+		To("event:device-status/bla/bla").
+		Payload([]byte("the payload has reached the checkpoint")).
+		Build()
 
 	if err = client.Send(myMessage); err != nil {
 		fmt.Println("Error sending message: ", err)
 	}
 
+	// events don't expect a response, so they don't need a transaction uuid
+	if err = client.SendEvent("event:device-status/mac:ffffff112233/online", []byte("online")); err != nil {
+		fmt.Println("Error sending event: ", err)
+	}
+
 	mainWG.Add(1)
 	mainWG.Wait()
 
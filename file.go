@@ -0,0 +1,84 @@
+package kratos
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// sendFileChunkSize is the size past which SendFile streams a file rather
+// than sending it in one message, and the size of the chunks it's streamed in
+var sendFileChunkSize int64 = 256 * 1024
+
+// FileError is returned by SendFile when the file couldn't be opened or read,
+// as opposed to the errors of the send itself
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("reading %s: %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying I/O error, such as os.ErrNotExist
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// fileReader reads a file, its errors made into FileError
+type fileReader struct {
+	*os.File
+}
+
+func (r fileReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	if err != nil && err != io.EOF {
+		err = &FileError{Path: r.Name(), Err: err}
+	}
+	return n, err
+}
+
+// SendFile sends the content of the file at path to destination, as the
+// payload of an event with contentType. A file larger than 256 KiB isn't
+// loaded whole but sent the way SendStream does, in chunks of that size
+// carrying contentType. Failing to open or read the file is reported with a
+// FileError, any other error comes from the send.
+func (c *client) SendFile(destination, path, contentType string) error {
+	return c.sendFile(c.Send, destination, path, contentType)
+}
+
+// sendFile is SendFile sending with send
+func (c *client) sendFile(send func(message interface{}) error, destination, path, contentType string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return &FileError{Path: path, Err: err}
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return &FileError{Path: path, Err: err}
+	}
+
+	r := fileReader{file}
+	if info.Size() > sendFileChunkSize {
+		return c.sendStream(send, destination, contentType, r, int(sendFileChunkSize))
+	}
+
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return send(wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      c.deviceID,
+		Destination: destination,
+		ContentType: contentType,
+		Payload:     payload,
+	})
+}
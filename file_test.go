@@ -0,0 +1,80 @@
+package kratos
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestSendFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kratos")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	small, large := filepath.Join(dir, "small.log"), filepath.Join(dir, "large.log")
+	assert.Nil(ioutil.WriteFile(small, []byte("0123"), 0600))
+	assert.Nil(ioutil.WriteFile(large, []byte("0123456789"), 0600))
+
+	defer func(size int64) { sendFileChunkSize = size }(sendFileChunkSize)
+	sendFileChunkSize = 4
+
+	var sent []wrp.Message
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Run(func(args mock.Arguments) {
+		var msg wrp.Message
+		assert.Nil(wrp.NewDecoderBytes(args.Get(1).([]byte), wrp.Msgpack).Decode(&msg))
+		sent = append(sent, msg)
+	})
+
+	testClient := &client{
+		deviceID:   "mac:ffffff112233",
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	// a file up to the chunk size goes in a single message
+	assert.Nil(testClient.SendFile("event:upload/logs", small, "text/plain"))
+	if assert.Len(sent, 1) {
+		assert.Equal("event:upload/logs", sent[0].Destination)
+		assert.Equal("text/plain", sent[0].ContentType)
+		assert.Equal("0123", string(sent[0].Payload))
+		assert.Empty(sent[0].Metadata)
+	}
+
+	// a larger one is streamed
+	sent = nil
+	assert.Nil(testClient.SendFile("event:upload/logs", large, "text/plain"))
+	if assert.Len(sent, 3) {
+		for i, payload := range []string{"0123", "4567", "89"} {
+			assert.Equal("text/plain", sent[i].ContentType)
+			assert.Equal(payload, string(sent[i].Payload))
+			assert.NotEmpty(sent[i].Metadata[StreamIDKey])
+		}
+	}
+
+	// I/O errors are told apart from send errors
+	err = testClient.SendFile("event:upload/logs", filepath.Join(dir, "missing.log"), "text/plain")
+	var fileErr *FileError
+	assert.True(errors.As(err, &fileErr))
+	assert.True(os.IsNotExist(errors.Unwrap(err)))
+
+	err = testClient.SendFile("event:upload/logs", dir, "text/plain")
+	assert.True(errors.As(err, &fileErr))
+
+	testClient.factory.ReadOnly = true
+	err = testClient.SendFile("event:upload/logs", small, "text/plain")
+	assert.Equal(ErrReadOnly, err)
+	assert.False(errors.As(err, &fileErr))
+}
@@ -11,7 +11,7 @@ require (
 	github.com/go-stack/stack v1.6.0 // indirect
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.6.1 // indirect
-	github.com/gorilla/websocket v1.2.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/hashicorp/hcl v0.0.0-20180404174102-ef8a98b0bbce // indirect
 	github.com/influxdata/influxdb v1.5.1-0.20180716155537-d977c0ac2494 // indirect
 	github.com/jtacoma/uritemplates v1.0.0 // indirect
@@ -0,0 +1,38 @@
+package kratos
+
+import "sync/atomic"
+
+// GoroutineCount is how many goroutines the client has running, such as its
+// read loop, its ping handler, reconnects and handlers with a MaxConcurrency.
+// Goroutines started by the handlers themselves aren't counted.
+func (c *client) GoroutineCount() int {
+	return int(atomic.LoadInt32(&c.goroutines))
+}
+
+// goroutine runs f in a goroutine counted by GoroutineCount. It is for the
+// goroutines the client can't do without, which are started even past
+// MaxGoroutines.
+func (c *client) goroutine(f func()) {
+	atomic.AddInt32(&c.goroutines, 1)
+	go func() {
+		defer atomic.AddInt32(&c.goroutines, -1)
+		f()
+	}()
+}
+
+// tryGoroutine is goroutine for work that may just as well be done by the
+// caller, returning false without running f when the client already has
+// MaxGoroutines running
+func (c *client) tryGoroutine(f func()) bool {
+	running := atomic.AddInt32(&c.goroutines, 1)
+	if max := c.factory.MaxGoroutines; max > 0 && running > int32(max) {
+		atomic.AddInt32(&c.goroutines, -1)
+		return false
+	}
+
+	go func() {
+		defer atomic.AddInt32(&c.goroutines, -1)
+		f()
+	}()
+	return true
+}
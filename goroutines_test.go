@@ -0,0 +1,57 @@
+package kratos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type flagHandler struct {
+	handled chan struct{}
+}
+
+func (h *flagHandler) HandleMessage(interface{}) {
+	close(h.handled)
+}
+
+// test that the goroutines are counted and that handlers run serially once
+// MaxGoroutines are running
+func TestMaxGoroutines(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{
+		Logger:   logging.New(nil),
+		shutdown: make(chan struct{}),
+		factory:  ClientFactory{MaxGoroutines: 1},
+	}
+
+	block := make(chan struct{})
+	assert.True(testClient.tryGoroutine(func() { <-block }))
+	assert.Equal(1, testClient.GoroutineCount())
+	assert.False(testClient.tryGoroutine(func() {}))
+	assert.Equal(1, testClient.GoroutineCount())
+
+	// the handler is called before handleRegistered returns
+	handler := &flagHandler{handled: make(chan struct{})}
+	testClient.handleRegistered(&HandlerRegistry{
+		HandlerKey: "/foo",
+		Handler:    handler,
+		slots:      make(chan struct{}, 2),
+	}, wrp.Message{Destination: "mac:ffffff112233/foo"}, nil)
+
+	select {
+	case <-handler.handled:
+	default:
+		assert.Fail("handler didn't run serially")
+	}
+
+	close(block)
+	deadline := time.Now().Add(3 * time.Second)
+	for testClient.GoroutineCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Zero(testClient.GoroutineCount())
+}
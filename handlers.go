@@ -0,0 +1,101 @@
+package kratos
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// compileHandler gets h ready to be matched against messages
+func (f *ClientFactory) compileHandler(h *HandlerRegistry) (err error) {
+	if n := h.MaxConcurrency; n > 0 {
+		h.slots = make(chan struct{}, n)
+	}
+
+	if h.SourceKey != "" {
+		if h.sourceRegex, err = regexp.Compile(h.SourceKey); err != nil {
+			return
+		}
+	}
+
+	if h.HandlerKey == "" && h.HeaderMatch != nil {
+		// routed on headers alone
+		h.keyMatch = nil
+		return
+	}
+
+	h.keyMatch, err = f.MatchMode.compile(h.HandlerKey)
+	return
+}
+
+// registeredHandlers returns the handlers currently registered, in the order
+// they are called. The slice is never changed, registering or deregistering
+// a handler replaces it.
+func (c *client) registeredHandlers() []HandlerRegistry {
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+	return c.handlers
+}
+
+// RegisterHandler adds h to the handlers of the client, after those of the
+// same or a higher Priority. It gets the messages read from then on, and
+// stays registered across reconnects until DeregisterHandler removes it. Its
+// HandlerKey is refused with ErrDuplicateHandlerKey when already registered
+// and RejectDuplicateHandlers is set.
+func (c *client) RegisterHandler(h HandlerRegistry) error {
+	if err := c.factory.compileHandler(&h); err != nil {
+		return err
+	}
+
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	position := len(c.handlers)
+	for i := len(c.handlers) - 1; i >= 0 && c.handlers[i].Priority < h.Priority; i-- {
+		position = i
+	}
+
+	for _, registered := range c.handlers {
+		if h.keyMatch == nil || registered.HandlerKey != h.HandlerKey {
+			continue
+		}
+
+		if c.factory.RejectDuplicateHandlers {
+			return fmt.Errorf("%w: %q is already registered", ErrDuplicateHandlerKey, h.HandlerKey)
+		}
+
+		logging.Warn(c).Log(logging.MessageKey(), "Handler key is registered more than once, all of its handlers will be called",
+			"handlerKey", h.HandlerKey)
+		break
+	}
+
+	handlers := make([]HandlerRegistry, 0, len(c.handlers)+1)
+	handlers = append(handlers, c.handlers[:position]...)
+	handlers = append(handlers, h)
+	c.handlers = append(handlers, c.handlers[position:]...)
+	return nil
+}
+
+// DeregisterHandler removes every handler registered with handlerKey, those of
+// the ClientFactory included, and tells whether there was any. They don't get
+// the messages read from then on, reconnects included, though a message
+// already given to them is still handled.
+func (c *client) DeregisterHandler(handlerKey string) bool {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	handlers := make([]HandlerRegistry, 0, len(c.handlers))
+	for _, registered := range c.handlers {
+		if registered.HandlerKey != handlerKey {
+			handlers = append(handlers, registered)
+		}
+	}
+
+	if len(handlers) == len(c.handlers) {
+		return false
+	}
+
+	c.handlers = handlers
+	return true
+}
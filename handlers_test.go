@@ -0,0 +1,72 @@
+package kratos
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type keyHandler struct {
+	key     string
+	handled *[]string
+}
+
+func (h *keyHandler) HandleMessage(interface{}) {
+	*h.handled = append(*h.handled, h.key)
+}
+
+// test that handlers registered after New are ordered by priority and get
+// the messages read from then on, and that deregistered ones don't
+func TestRegisterHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	var handled []string
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{
+				HandlerKey: "/foo",
+				keyMatch:   regexp.MustCompile("/foo"),
+				Handler:    &keyHandler{key: "foo", handled: &handled},
+			},
+		},
+		Logger: logging.New(nil),
+	}
+	before := testClient.registeredHandlers()
+
+	assert.Nil(testClient.RegisterHandler(HandlerRegistry{
+		HandlerKey: "/",
+		Handler:    &keyHandler{key: "low", handled: &handled},
+		Priority:   -1,
+	}))
+	assert.Nil(testClient.RegisterHandler(HandlerRegistry{
+		HandlerKey: "/foo/bar",
+		Handler:    &keyHandler{key: "high", handled: &handled},
+		Priority:   1,
+	}))
+	assert.NotNil(testClient.RegisterHandler(HandlerRegistry{HandlerKey: "("}))
+
+	// a snapshot taken earlier isn't changed
+	assert.Len(before, 1)
+
+	testClient.dispatch(wrp.Message{Destination: "mac:ffffff112233/foo/bar"}, nil)
+	assert.Equal([]string{"high", "foo", "low"}, handled)
+	assert.Equal([]string{"/foo/bar", "/foo", "/"}, testClient.WouldMatch("mac:ffffff112233/foo/bar"))
+
+	// a duplicate is only warned about unless rejected
+	assert.Nil(testClient.RegisterHandler(HandlerRegistry{HandlerKey: "/", Handler: &keyHandler{key: "dup", handled: &handled}}))
+	testClient.factory.RejectDuplicateHandlers = true
+	assert.True(errors.Is(testClient.RegisterHandler(HandlerRegistry{HandlerKey: "/foo"}), ErrDuplicateHandlerKey))
+
+	assert.True(testClient.DeregisterHandler("/"))
+	assert.True(testClient.DeregisterHandler("/foo"))
+	assert.False(testClient.DeregisterHandler("/foo"))
+
+	handled = nil
+	testClient.dispatch(wrp.Message{Destination: "mac:ffffff112233/foo/bar"}, nil)
+	assert.Equal([]string{"high"}, handled)
+	assert.Len(before, 1)
+}
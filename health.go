@@ -0,0 +1,132 @@
+package kratos
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthThresholds configures when Healthy considers the client unhealthy.
+// Each check is skipped when its threshold is zero.
+type HealthThresholds struct {
+	// MaxPongAge is how long the client may go without a pong from the server.
+	MaxPongAge time.Duration
+
+	// MaxMessageAge is how long the client may go without receiving a message.
+	MaxMessageAge time.Duration
+
+	// MaxReconnects is how many reconnects are tolerated within ReconnectWindow.
+	MaxReconnects   int
+	ReconnectWindow time.Duration
+}
+
+// health tracks what Healthy needs to know about the connection
+type health struct {
+	connected   bool
+	connectedAt time.Time
+	lastPong    time.Time
+	lastMessage time.Time
+	reconnects  []time.Time
+}
+
+// Healthy tells whether the client is in a good state: connected, hearing
+// pongs and messages recently enough and not reconnecting too often, per the
+// HealthThresholds. When it isn't, the reason explains the first check that
+// failed.
+func (c *client) Healthy() (bool, string) {
+	thresholds := c.factory.HealthThresholds
+	now := c.clock().Now()
+
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+
+	if !c.health.connected {
+		return false, "not connected"
+	}
+
+	if thresholds.MaxPongAge > 0 {
+		lastPong := c.health.lastPong
+		if lastPong.Before(c.health.connectedAt) {
+			lastPong = c.health.connectedAt
+		}
+
+		if age := now.Sub(lastPong); age > thresholds.MaxPongAge {
+			return false, fmt.Sprintf("no pong for %s", age)
+		}
+	}
+
+	if thresholds.MaxMessageAge > 0 {
+		lastMessage := c.health.lastMessage
+		if lastMessage.Before(c.health.connectedAt) {
+			lastMessage = c.health.connectedAt
+		}
+
+		if age := now.Sub(lastMessage); age > thresholds.MaxMessageAge {
+			return false, fmt.Sprintf("no message for %s", age)
+		}
+	}
+
+	if thresholds.MaxReconnects > 0 {
+		c.pruneReconnects(now)
+		if count := len(c.health.reconnects); count > thresholds.MaxReconnects {
+			return false, fmt.Sprintf("%d reconnects in the last %s", count, thresholds.ReconnectWindow)
+		}
+	}
+
+	return true, "healthy"
+}
+
+func (c *client) markConnected(connected bool) {
+	c.healthLock.Lock()
+	c.health.connected = connected
+	if connected {
+		c.health.connectedAt = c.clock().Now()
+	}
+	c.healthLock.Unlock()
+}
+
+// markLost marks the client disconnected once the read loop of conn is over,
+// unless conn was replaced meanwhile. The writeLock is held throughout so
+// that a new connection can't be installed and marked connected in between.
+func (c *client) markLost(conn websocketConnection) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.connection == conn {
+		c.markConnected(false)
+	}
+}
+
+func (c *client) markReconnected() {
+	c.healthLock.Lock()
+	now := c.clock().Now()
+	c.health.reconnects = append(c.health.reconnects, now)
+	c.pruneReconnects(now)
+	c.healthLock.Unlock()
+}
+
+func (c *client) markPong() {
+	c.healthLock.Lock()
+	c.health.lastPong = c.clock().Now()
+	c.healthLock.Unlock()
+}
+
+func (c *client) markMessage() {
+	c.healthLock.Lock()
+	c.health.lastMessage = c.clock().Now()
+	c.healthLock.Unlock()
+}
+
+// pruneReconnects drops the reconnects that fell out of the window, the
+// caller must hold healthLock
+func (c *client) pruneReconnects(now time.Time) {
+	window := c.factory.HealthThresholds.ReconnectWindow
+	if window <= 0 {
+		return
+	}
+
+	i := 0
+	for i < len(c.health.reconnects) && now.Sub(c.health.reconnects[i]) > window {
+		i++
+	}
+	c.health.reconnects = c.health.reconnects[i:]
+}
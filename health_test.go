@@ -0,0 +1,66 @@
+package kratos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthy(t *testing.T) {
+	thresholds := HealthThresholds{
+		MaxPongAge:      time.Minute,
+		MaxMessageAge:   time.Hour,
+		MaxReconnects:   2,
+		ReconnectWindow: 10 * time.Minute,
+	}
+
+	now := time.Now()
+	tests := []struct {
+		description string
+		health      health
+		healthy     bool
+		reason      string
+	}{
+		{"disconnected", health{}, false, "not connected"},
+		{"just connected", health{connected: true, connectedAt: now}, true, "healthy"},
+		{"stale pong", health{connected: true, connectedAt: now.Add(-2 * time.Hour), lastPong: now.Add(-2 * time.Minute), lastMessage: now}, false, "no pong"},
+		{"stale message", health{connected: true, connectedAt: now.Add(-2 * time.Hour), lastPong: now, lastMessage: now.Add(-90 * time.Minute)}, false, "no message"},
+		{"flapping", health{connected: true, connectedAt: now, reconnects: []time.Time{now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute)}}, false, "3 reconnects"},
+		{"old reconnects", health{connected: true, connectedAt: now, reconnects: []time.Time{now.Add(-time.Hour), now.Add(-50 * time.Minute), now.Add(-time.Minute)}}, true, "healthy"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			testClient := &client{
+				factory: ClientFactory{HealthThresholds: thresholds},
+				health:  tc.health,
+			}
+
+			healthy, reason := testClient.Healthy()
+			assert.Equal(tc.healthy, healthy)
+			assert.Contains(reason, tc.reason)
+		})
+	}
+}
+
+// test that the end of the read loop of a connection already replaced doesn't
+// mark the client disconnected
+func TestMarkLost(t *testing.T) {
+	assert := assert.New(t)
+
+	oldConn, newConn := &mockConnection{}, &mockConnection{}
+	testClient := &client{connection: newConn}
+	testClient.markConnected(true)
+
+	testClient.markLost(oldConn)
+	healthy, _ := testClient.Healthy()
+	assert.True(healthy)
+
+	testClient.markLost(newConn)
+	healthy, reason := testClient.Healthy()
+	assert.False(healthy)
+	assert.Equal("not connected", reason)
+}
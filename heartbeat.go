@@ -0,0 +1,55 @@
+package kratos
+
+import (
+	"time"
+
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// HeartbeatEvent configures a WRP event the client sends on its own at a
+// regular interval, for servers tracking the presence of devices at the
+// application level rather than through websocket pings.
+type HeartbeatEvent struct {
+	// Destination of the events, such as
+	// event:device-status/mac:ffffff112233/online
+	Destination string
+
+	// Payload builds the payload of each event, which is empty when it is nil
+	Payload func() []byte
+
+	// Interval between two events. Nothing is sent unless it is positive.
+	Interval time.Duration
+}
+
+// startHeartbeat sends the HeartbeatEvent, if there is one, until the client
+// is closed
+func (c *client) startHeartbeat() {
+	heartbeat := c.factory.HeartbeatEvent
+	if heartbeat == nil || heartbeat.Interval <= 0 {
+		return
+	}
+
+	c.goroutine(func() {
+		ticker := c.clock().NewTicker(heartbeat.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.shutdown:
+				return
+			case <-ticker.C():
+			}
+
+			var payload []byte
+			if heartbeat.Payload != nil {
+				payload = heartbeat.Payload()
+			}
+
+			// like any other message it goes through the serialized writes
+			if err := c.SendEvent(heartbeat.Destination, payload); err != nil {
+				logging.Warn(c).Log(logging.MessageKey(), "Failed to send heartbeat event",
+					"destination", heartbeat.Destination, logging.ErrorKey(), err)
+			}
+		}
+	})
+}
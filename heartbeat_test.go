@@ -0,0 +1,56 @@
+package kratos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// test that heartbeat events go out on the connection until the client closes
+func TestHeartbeatEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	sent := make(chan []byte, 10)
+	testClient := &client{
+		deviceID:   "mac:ffffff112233",
+		connection: &channelConnection{written: sent},
+		factory: ClientFactory{
+			HeartbeatEvent: &HeartbeatEvent{
+				Destination: "event:device-status/mac:ffffff112233/online",
+				Payload:     func() []byte { return []byte("alive") },
+				Interval:    time.Millisecond,
+			},
+		},
+		shutdown: make(chan struct{}),
+		Logger:   logging.New(nil),
+	}
+
+	testClient.startHeartbeat()
+
+	var event wrp.Message
+	assert.Nil(wrp.NewDecoderBytes(<-sent, wrp.Msgpack).Decode(&event))
+	assert.Equal(wrp.SimpleEventMessageType, event.Type)
+	assert.Equal("mac:ffffff112233", event.Source)
+	assert.Equal("event:device-status/mac:ffffff112233/online", event.Destination)
+	assert.Equal([]byte("alive"), event.Payload)
+
+	close(testClient.shutdown)
+}
+
+// channelConnection passes on what is written to it, as long as there is
+// room in written
+type channelConnection struct {
+	discardConnection
+	written chan []byte
+}
+
+func (c *channelConnection) WriteMessage(messageType int, data []byte) error {
+	select {
+	case c.written <- append([]byte(nil), data...):
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package kratos
+
+import "time"
+
+// ReconnectReason tells what made the client reconnect
+type ReconnectReason string
+
+const (
+	// ReconnectServerClose is the server closing the connection with a
+	// service restart (1012) or try again later (1013) code.
+	ReconnectServerClose ReconnectReason = "server-close"
+
+	// ReconnectMaxAge is the connection reaching MaxConnectionAge.
+	ReconnectMaxAge ReconnectReason = "max-age"
+
+	// ReconnectHandlerTimeout is a handler running past HandlerHardTimeout.
+	ReconnectHandlerTimeout ReconnectReason = "handler-timeout"
+
+	// ReconnectWriteError is a write failing, which gorilla makes every
+	// later write on the connection fail as well.
+	ReconnectWriteError ReconnectReason = "write-error"
+
+	// ReconnectPingMiss is a ping that couldn't be written.
+	ReconnectPingMiss ReconnectReason = "ping-miss"
+
+	// ReconnectReadError is a read failing without the server closing the
+	// connection, such as when the read deadline passes.
+	ReconnectReadError ReconnectReason = "read-error"
+)
+
+// ReconnectEvent is one attempt at reconnecting
+type ReconnectEvent struct {
+	// Time is when the attempt was made.
+	Time time.Time
+
+	Reason ReconnectReason
+
+	// Detail adds to the Reason, like the close code sent by the server.
+	Detail string
+
+	// Delay is how long the client waited before this attempt.
+	Delay time.Duration
+
+	Succeeded bool
+
+	// Err is why the attempt failed.
+	Err error
+}
+
+// ReconnectHistory returns the last reconnect attempts, up to
+// ReconnectHistorySize of them, from the oldest to the most recent. It
+// returns nil when ReconnectHistorySize isn't set.
+func (c *client) ReconnectHistory() []ReconnectEvent {
+	if c.reconnects == nil {
+		return nil
+	}
+	items := c.reconnects.snapshot()
+	events := make([]ReconnectEvent, len(items))
+	for i, item := range items {
+		events[i] = item.(ReconnectEvent)
+	}
+	return events
+}
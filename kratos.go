@@ -2,15 +2,23 @@ package kratos
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -30,9 +38,19 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
+	// Default time allowed for the server to answer our close frame with its own.
+	closeGracePeriod = time.Second
+
+	// Default maximum message size allowed from peer.
 	maxMessageSize = 2048
 
+	// How many times petasos is asked for a backend when the ones it picks
+	// can't be reached.
+	maxDiscoveryAttempts = 2
+
+	// Default header carrying the device name.
+	defaultDeviceNameHeader = "X-Webpa-Device-Name"
+
 	StatusDeviceDisconnected int = 523
 	StatusDeviceTimeout      int = 524
 )
@@ -49,68 +67,785 @@ type ClientFactory struct {
 	Handlers       []HandlerRegistry
 	HandlePingMiss HandlePingMiss
 	ClientLogger   log.Logger
+
+	// NetDial, when set, is used to open the TCP connections for both the
+	// discovery request and the websocket dial.
+	NetDial func(network, addr string) (net.Conn, error)
+
+	// OnReconnectDirective is called when the server closes the connection
+	// asking the client to come back, either right away because the service
+	// is restarting (1012) or later because it is overloaded (1013). It gets
+	// the close code, the reason sent by the server and how long the client
+	// will wait before reconnecting.
+	OnReconnectDirective func(code int, reason string, delay time.Duration)
+
+	// CloseGracePeriod bounds how long Close waits for the server to answer
+	// the close frame before the connection is dropped. Zero uses the default
+	// of one second.
+	CloseGracePeriod time.Duration
+
+	// MaxMessageSize is the largest message, in bytes, that will be read from
+	// the server once all of its fragments have been reassembled. Zero uses
+	// the default of 2048 bytes and a negative value disables the limit. It
+	// doesn't apply to what is sent, see MaxSendMessageSize.
+	MaxMessageSize int64
+
+	// RejectDuplicateHandlers makes New fail with ErrDuplicateHandlerKey when
+	// two Handlers share a HandlerKey. Otherwise duplicates are only logged and
+	// every handler registered for the key is called.
+	RejectDuplicateHandlers bool
+
+	// AllowedSchemes restricts the device id schemes, such as mac, uuid,
+	// serial or dns, that New accepts in DeviceName. Any scheme is accepted
+	// when it is empty.
+	AllowedSchemes []string
+
+	// OnPong is called for every pong received from the server with the round
+	// trip time since the matching ping was sent.
+	OnPong func(rtt time.Duration)
+
+	// DialTLSContext, when set, opens the TLS connections for both discovery
+	// and the websocket dial, handshake included, which allows for checks
+	// tls.Config can't express. It takes precedence over CRT and Key.
+	DialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DefaultHandler receives the messages that didn't match any of the
+	// Handlers, which would otherwise be dropped. Unlike a ".*" handler it is
+	// never called for a message another handler already took care of.
+	DefaultHandler ReadHandler
+
+	// BootTime is when the device booted, sent as a unix timestamp in the
+	// X-Webpa-Boot-Time header during discovery and the websocket dial so
+	// the server can tell reboots from reconnects. Zero uses the time the
+	// process started.
+	BootTime time.Time
+
+	// MaxConnectionAge, when set, makes the client close its connection and
+	// go back through discovery once the connection is this old, which
+	// spreads long lived connections over the backends. Each connection
+	// picks a lifetime up to a tenth shorter at random so a fleet doesn't
+	// reconnect all at once.
+	MaxConnectionAge time.Duration
+
+	// DecodeInto, when set, returns the value each received message is
+	// decoded into instead of a full wrp.Message, so a struct holding only
+	// the fields a consumer needs can be used. It must return a pointer.
+	// Handlers get that pointer, and it is only matched against HandlerKey
+	// when it has a To() string method returning the destination, otherwise
+	// it goes to the DefaultHandler. Such messages never complete a
+	// SendWithResponse or OnAck.
+	DecodeInto func() interface{}
+
+	// RawHandler, when set, receives the bytes of every message without any
+	// decoding, taking the place of all the other handlers.
+	RawHandler func(message []byte)
+
+	// HealthThresholds configures the checks made by Healthy.
+	HealthThresholds HealthThresholds
+
+	// ReconnectStrategy chooses the backend a reconnect dials, either
+	// Rediscover, which is the default, SameBackend or a custom function.
+	ReconnectStrategy ReconnectStrategy
+
+	// MaxBufferedBytes caps the size of the encoded messages waiting to be
+	// written, past which Send fails with ErrBufferFull. Zero means no limit.
+	// It doesn't apply to the messages read ahead of the handlers, with
+	// ReadBatchSize or while dispatch is paused: those are bounded in number
+	// by ReadBatchSize and PauseBufferSize, each being at most MaxMessageSize,
+	// and counted by Stats in UnprocessedInbound.
+	MaxBufferedBytes int64
+
+	// Metrics, when set, receives the latencies of discovery and of the
+	// websocket dial and counts the messages received per service.
+	Metrics Metrics
+
+	// SkipUndecodableMessages keeps the client reading when a message can't be
+	// decoded, dropping only that message. Otherwise the client stops reading
+	// as it does when the connection itself fails.
+	SkipUndecodableMessages bool
+
+	// Labels, such as a tenant or partner, are added to every log line of the
+	// client and to its metrics when Metrics is a LabeledMetrics. They are
+	// copied by New, so changing the map afterwards has no effect.
+	Labels map[string]string
+
+	// HandlerHardTimeout, when set, is how long a handler may take with a
+	// message before the client is deemed unhealthy: OnHandlerTimeout is
+	// called and the client reconnects. The handler isn't interrupted.
+	HandlerHardTimeout time.Duration
+
+	// OnHandlerTimeout is called with the key of a handler that ran past
+	// HandlerHardTimeout.
+	OnHandlerTimeout func(handlerKey string)
+
+	// ReadOnly makes an observer client that receives and dispatches messages
+	// but never sends any: every send fails with ErrReadOnly. Pings and the
+	// close handshake are still written.
+	ReadOnly bool
+
+	// Subprotocols are the websocket subprotocols offered to the server, in
+	// order of preference. Subprotocol tells which one it selected.
+	Subprotocols []string
+
+	// RecentMessageBuffer, when set, is how many of the last messages received
+	// are kept for RecentMessages, to help debugging in the field.
+	RecentMessageBuffer int
+
+	// WriteRetry makes a send that failed with a temporary error, such as a
+	// write timeout, be tried once more on a new connection. A websocket
+	// can't be written to anymore once a write failed, so the client
+	// reconnects after any write error, and with WriteRetry the send waits
+	// for it up to its write deadline. Other errors, like a closed
+	// connection, fail right away.
+	WriteRetry bool
+
+	// ValidateOutbound makes Send check that a message has the fields its WRP
+	// type requires, such as a source and a destination, before writing it,
+	// and fail with ErrInvalidMessage otherwise.
+	ValidateOutbound bool
+
+	// BeforeDial is called with the discovery request right before it is
+	// sent, to add computed headers, sign the request or log it. Its headers
+	// and URL may be changed, its context and body must not.
+	BeforeDial func(req *http.Request)
+
+	// BeforeHandshake is called right before every websocket dial with the URL
+	// being dialed and the headers of the handshake, which may be changed.
+	// The Upgrade, Connection, Sec-Websocket-Key, Sec-Websocket-Version and
+	// Sec-Websocket-Extensions headers are set by the dialer and can't be.
+	BeforeHandshake func(wsURL string, header http.Header)
+
+	// ReadDeadline is how long the client waits to hear from the server, a
+	// pong included, before it gives up on the connection. Zero uses the
+	// default of five minutes. A negative value removes the deadline
+	// altogether: a connection that silently died, with the server gone
+	// without a close, is then only noticed once a ping can't be written or
+	// TCP keepalive gives up, which may take much longer.
+	ReadDeadline time.Duration
+
+	// PingPeriod is how often the server is pinged, which has to be shorter
+	// than the read deadline for the pongs to push it back in time. Zero
+	// pings at nine tenths of the read deadline, or every four and a half
+	// minutes when there is none.
+	PingPeriod time.Duration
+
+	// ReconnectHistorySize, when set, is how many of the last reconnect
+	// attempts are kept for ReconnectHistory.
+	ReconnectHistorySize int
+
+	// DialSemaphore, when set, limits how many clients sharing it connect at
+	// the same time to its capacity, discovery and dial included, which keeps
+	// a simulator starting thousands of devices from overwhelming petasos or
+	// the network stack: make(chan struct{}, 50) lets 50 connect at once.
+	DialSemaphore chan struct{}
+
+	// OnConnect is called after every successful connection, the first one
+	// and every reconnect, before the client is handed out or pending requests
+	// are sent again, to send the messages the server expects first, such as
+	// a registration. Messages can already be sent and received. When it
+	// fails the connection is dropped: New returns the error and a reconnect
+	// tries again later.
+	OnConnect func(c Client) error
+
+	// HeartbeatEvent, when set, makes the client send a WRP event at a
+	// regular interval for as long as it isn't closed
+	HeartbeatEvent *HeartbeatEvent
+
+	// ReconnectBudget caps the number of reconnect attempts within a rolling
+	// window. OnReconnectBudgetExhausted, when set, is called with the
+	// cooldown every time the budget is spent.
+	ReconnectBudget            ReconnectBudget
+	OnReconnectBudgetExhausted func(cooldown time.Duration)
+
+	// CompressionMinSize, when positive, offers the server per-message
+	// deflate and compresses the messages at least this many bytes long once
+	// encoded, leaving the smaller ones, not worth the CPU, uncompressed.
+	CompressionMinSize int
+
+	// OnPingSent and OnPongReceived are called for every ping written to the
+	// server and every pong it sends back, to follow the heartbeat of the
+	// connection closer than HandlePingMiss allows.
+	OnPingSent     func()
+	OnPongReceived func(appData string)
+
+	// ReadBatchSize, when more than one, splits reading from dispatching:
+	// messages keep being read off the connection while the handlers run,
+	// and are then dispatched in batches of up to this many, for clients
+	// receiving at a high rate.
+	ReadBatchSize int
+
+	// Services lists the services the device hosts, such as config or
+	// logging, advertised to the server in the X-Webpa-Services header of the
+	// handshake. New warns about those no handler would be given messages for.
+	Services []string
+
+	// MatchMode tells how HandlerKey is matched against destinations, as a
+	// regular expression by default.
+	MatchMode MatchMode
+
+	// HandshakeChallenge, when set, is given the response to every websocket
+	// handshake, its body already closed, and returns the message to answer
+	// a challenge it carries with, if any. The message is sent right after
+	// connecting, before OnConnect is called, and the connection is dropped
+	// when it returns an error.
+	HandshakeChallenge func(resp *http.Response) (firstMessage interface{}, err error)
+
+	// OnBackoff is called right before each wait of a reconnect, with the
+	// number of the attempt coming after it, counted from 1, how long the
+	// wait is and why it is made.
+	OnBackoff func(attempt int, delay time.Duration, reason string)
+
+	// DeviceNameHeader is the header carrying DeviceName during discovery
+	// and the websocket dial, X-Webpa-Device-Name by default. It is sent
+	// with the casing given.
+	DeviceNameHeader string
+
+	// SessionIDHeader is the header of the handshake response holding the
+	// id of the session the server opened, handed to OnReconnectDial.
+	SessionIDHeader string
+
+	// OnReconnectDial is called before every dial of a reconnect, but not of
+	// the first connection, with the session id the previous handshake
+	// yielded, if any, and headers to set for the next handshake only, such
+	// as a Last-Session-Id to resume the session.
+	OnReconnectDial func(prevSessionID string, headers http.Header)
+
+	// MaxSendMessageSize is the largest encoded message, in bytes, the client
+	// sends, larger ones failing with ErrMessageTooLarge. Zero or a negative
+	// value leaves sends unbounded, MaxMessageSize only ever limiting what is
+	// read. Set both to the same value for a symmetric protocol.
+	MaxSendMessageSize int64
+
+	// MaxGoroutines caps the goroutines the client runs at once, as told by
+	// GoroutineCount. Those it can't work without, reading, pinging or
+	// reconnecting, are always started, but past the cap the handlers with a
+	// MaxConcurrency are called serially by the read loop instead. Zero or a
+	// negative value sets no cap.
+	MaxGoroutines int
+
+	// DestinationEndpoints, when set, are used for discovery in place of
+	// DestinationURL. Each connection goes through one of them picked at
+	// random by weight, falling back to the others when it fails.
+	DestinationEndpoints []WeightedEndpoint
+
+	// OnUnmatched is called with the messages neither a handler nor the
+	// DefaultHandler took, such as those for a service the device no longer
+	// hosts. It only observes them, and doesn't see the messages decoded
+	// with DecodeInto or given to the RawHandler.
+	OnUnmatched func(msg wrp.Message)
+
+	// WRPVersion is the version of the WRP message schema the server
+	// expects, WRPVersion2 by default. With WRPVersion1 the fields it lacks
+	// are never sent nor read, and NewMessage doesn't set them.
+	WRPVersion WRPVersion
+
+	// WriteDeadlineFunc, when set, gives the time a message of size encoded
+	// bytes has to be written, such as a base plus size divided by the
+	// slowest throughput expected, so that large messages don't time out on
+	// a slow link while small ones keep a tight deadline. The default of ten
+	// seconds is used when it returns zero or less, and SendWithDeadline
+	// overrides it.
+	WriteDeadlineFunc func(size int) time.Duration
+
+	// PauseBufferSize is how many messages are held while dispatch is paused
+	// by PauseDispatch, those beyond being dropped. Zero or a negative value
+	// uses the default of 1024.
+	PauseBufferSize int
+
+	// clock replaces the real clock in tests
+	clock clock
+
+	// MaxInflightRequests caps the SendWithResponse calls waiting on a
+	// response, as told by InflightRequests. Once it is reached the next
+	// call waits for one of them to end, or fails with ErrTooManyInflight
+	// when RejectWhenInflightFull is set. Zero or a negative value sets no
+	// cap.
+	MaxInflightRequests int
+
+	// RejectWhenInflightFull makes SendWithResponse fail right away rather
+	// than wait when MaxInflightRequests calls are in flight.
+	RejectWhenInflightFull bool
+
+	// PinnedCertFingerprints are the SHA-256 fingerprints of the server
+	// certificates trusted, checked during both discovery and the websocket
+	// dial on top of the usual verification. A connection is refused with
+	// ErrCertificateNotPinned unless the leaf or one of the chain presented
+	// has one of them. They are ignored along with the rest of the TLS
+	// configuration when DialTLSContext is set.
+	PinnedCertFingerprints [][32]byte
+
+	// AutoAck makes the client answer every request it's sent, a WRP
+	// message expecting a response such as a SimpleRequestResponse or CRUD
+	// message with a TransactionUUID, with an ack before the handlers are
+	// given the request. The handlers may still send the full response.
+	// Messages decoded with DecodeInto or given to the RawHandler aren't
+	// acked.
+	AutoAck bool
+
+	// AckBuilder makes the ack of received when AutoAck is set. The ack
+	// always carries the TransactionUUID of received. When nil, the ack is
+	// a SimpleRequestResponse back to the source of received with a 202
+	// Accepted status and no payload.
+	AckBuilder func(received wrp.Message) wrp.Message
+
+	// VerifyOnConnect makes every connection, the first one made by New as
+	// well as those of the reconnects, send a ping and wait for its pong
+	// before it's used, so that a half-open connection is caught right away.
+	// A connection without a pong within ConnectTimeout is dropped, New
+	// failing with ErrConnectionNotVerified and a reconnect trying again.
+	VerifyOnConnect bool
+
+	// ConnectTimeout is how long VerifyOnConnect waits for the pong, 10
+	// seconds when zero.
+	ConnectTimeout time.Duration
 }
 
+// ErrDuplicateHandlerKey is returned by New and RegisterHandler when
+// RejectDuplicateHandlers is set and the same HandlerKey is registered more
+// than once
+var ErrDuplicateHandlerKey = errors.New("duplicate handler key")
+
+// ErrDeviceSchemeNotAllowed is returned by New when the scheme of DeviceName
+// isn't one of the AllowedSchemes
+var ErrDeviceSchemeNotAllowed = errors.New("device id scheme not allowed")
+
+// ErrInvalidFrameType is returned by SendFrame for anything but a binary or
+// text websocket frame
+var ErrInvalidFrameType = errors.New("invalid websocket frame type")
+
+// ErrMessageTooLarge is returned when sending a message larger than
+// MaxSendMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrReadOnly is returned when sending with a client made with ReadOnly set
+var ErrReadOnly = errors.New("client is read only")
+
+// ErrInvalidPingPeriod is returned by SetPingPeriod for a period that isn't
+// shorter than the time the client waits for a pong
+var ErrInvalidPingPeriod = errors.New("invalid ping period")
+
+// ErrNotConnected is returned when sending with a client that never connected
+var ErrNotConnected = errors.New("client is not connected")
+
+// ErrClientClosed is returned when connecting a client that has been closed
+var ErrClientClosed = errors.New("client closed")
+
 // New is used to create a new kratos Client from a ClientFactory
 func (f *ClientFactory) New() (Client, error) {
-	inHeader := &clientHeader{
-		deviceName:   f.DeviceName,
-		firmwareName: f.FirmwareName,
-		modelName:    f.ModelName,
-		manufacturer: f.Manufacturer,
+	return f.NewCtx(context.Background())
+}
+
+// NewCtx is like New, but the whole creation of the client, including the
+// discovery request and the websocket dial, is bound to ctx. If ctx is
+// canceled or its deadline passes, any connection made so far is closed
+// and ctx.Err() is returned.
+func (f *ClientFactory) NewCtx(ctx context.Context) (Client, error) {
+	newClient, err := f.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = newClient.connect(ctx); err != nil {
+		return nil, err
 	}
 
-	newConnection, connectionURL, err := createConnection(inHeader, f.DestinationURL, f.CRT, f.Key)
+	newClient.startHeartbeat()
+	return newClient, nil
+}
 
+// NewWithConn creates a client that performs only the websocket handshake for
+// wsURL over conn, a connection the caller has already established, skipping
+// discovery and dialing. conn can't be reused, so once it is lost the client
+// goes through the usual discovery at DestinationURL, dialing with NetDial
+// when it is set, or stays disconnected if there is no DestinationURL nor
+// DestinationEndpoints.
+func (f *ClientFactory) NewWithConn(conn net.Conn, wsURL string) (Client, error) {
+	newClient, err := f.newClient()
 	if err != nil {
 		return nil, err
 	}
 
-	newConnection.SetReadLimit(maxMessageSize)
-	_ = newConnection.SetReadDeadline(time.Now().Add(pongWait))
-	newConnection.SetPongHandler(func(string) error { _ = newConnection.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	newClient.adoptedConn = conn
+	newClient.adoptedURL = wsURL
 
-	// at this point we know that the URL connection is legitimate, so we can do some string manipulation
-	// with the knowledge that `:` will be found in the string twice
-	//connectionURL = connectionURL[len("ws://"):strings.LastIndex(connectionURL, ":")]
-	myPingMissHandler := pingHandler{
-		conn:           newConnection,
-		handlePingMiss: f.HandlePingMiss,
-		stop:           make(chan bool),
+	if err = newClient.connect(context.Background()); err != nil {
+		return nil, err
+	}
+
+	newClient.startHeartbeat()
+	return newClient, nil
+}
+
+// newClient builds a client from the factory without connecting it
+func (f *ClientFactory) newClient() (*client, error) {
+	// the device id is validated once here since it can't change across reconnects
+	deviceID, err := device.ParseID(f.DeviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = f.validateTiming(); err != nil {
+		return nil, err
+	}
+
+	if version := f.wrpVersion(); version != WRPVersion1 && version != WRPVersion2 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedWRPVersion, version)
+	}
+
+	scheme := deviceScheme(deviceID)
+	if len(f.AllowedSchemes) > 0 && !containsFold(f.AllowedSchemes, scheme) {
+		return nil, fmt.Errorf("%w: %q is not one of %v", ErrDeviceSchemeNotAllowed, scheme, f.AllowedSchemes)
+	}
+
+	inHeader := &clientHeader{
+		deviceName:   f.DeviceName,
+		firmwareName: f.FirmwareName,
+		modelName:    f.ModelName,
+		manufacturer: f.Manufacturer,
+		bootTime:     f.BootTime,
+		services:     f.Services,
+
+		deviceNameHeader: f.DeviceNameHeader,
+	}
+
+	if inHeader.bootTime.IsZero() {
+		inHeader.bootTime = processStart
 	}
 
 	newClient := &client{
 		deviceID:        inHeader.deviceName,
+		deviceScheme:    scheme,
 		userAgent:       "WebPA-1.6(" + inHeader.firmwareName + ";" + inHeader.modelName + "/" + inHeader.manufacturer + ";)",
 		deviceProtocols: "TODO-what-to-put-here",
-		hostname:        connectionURL,
-		handlers:        f.Handlers,
-		connection:      newConnection,
+		handlers:        append([]HandlerRegistry(nil), f.Handlers...),
 		headerInfo:      inHeader,
-		pingHandler:     myPingMissHandler,
+		factory:         *f,
+		transactions:    make(map[string]*transaction),
+		shutdown:        make(chan struct{}),
+	}
+
+	if f.RecentMessageBuffer > 0 {
+		newClient.recent = newRing(f.RecentMessageBuffer)
+	}
+
+	if f.MaxInflightRequests > 0 {
+		newClient.inflightSlots = make(chan struct{}, f.MaxInflightRequests)
+	}
+
+	if f.ReconnectHistorySize > 0 {
+		newClient.reconnects = newRing(f.ReconnectHistorySize)
 	}
 
 	if f.ClientLogger != nil {
 		newClient.Logger = f.ClientLogger
-		myPingMissHandler.Logger = f.ClientLogger
 	} else {
 		newClient.Logger = logging.DefaultLogger()
-		myPingMissHandler.Logger = logging.DefaultLogger()
 	}
 
+	if len(f.Labels) > 0 {
+		newClient.factory.Labels = copyLabels(f.Labels)
+		newClient.Logger = log.With(newClient.Logger, labelKeyvals(newClient.factory.Labels)...)
+
+		if labeled, ok := f.Metrics.(LabeledMetrics); ok {
+			newClient.factory.Metrics = labeled.WithLabels(copyLabels(f.Labels))
+		}
+	}
+
+	// the id changes with every connection, so it is looked up every time
+	newClient.Logger = log.With(newClient.Logger, "connectionID", log.Valuer(func() interface{} {
+		return newClient.ConnectionID()
+	}))
+
+	firstIndex := make(map[string]int, len(newClient.handlers))
 	for i := range newClient.handlers {
-		newClient.handlers[i].keyRegex, err = regexp.Compile(newClient.handlers[i].HandlerKey)
-		if err != nil {
+		if err = f.compileHandler(&newClient.handlers[i]); err != nil {
 			return nil, err
 		}
+
+		key := newClient.handlers[i].HandlerKey
+		if newClient.handlers[i].keyMatch == nil {
+			// routed on headers alone
+			continue
+		}
+
+		if j, ok := firstIndex[key]; ok {
+			if f.RejectDuplicateHandlers {
+				return nil, fmt.Errorf("%w: %q is used by handlers %d and %d", ErrDuplicateHandlerKey, key, j, i)
+			}
+
+			logging.Warn(newClient).Log(logging.MessageKey(), "Handler key is registered more than once, all of its handlers will be called",
+				"handlerKey", key, "firstIndex", j, "duplicateIndex", i)
+		} else {
+			firstIndex[key] = i
+		}
 	}
 
-	go myPingMissHandler.checkPing(newClient)
-	go newClient.read()
+	sort.SliceStable(newClient.handlers, func(i, j int) bool {
+		return newClient.handlers[i].Priority > newClient.handlers[j].Priority
+	})
+
+	newClient.logHandlerConflicts()
+	for _, service := range newClient.unhandledServices() {
+		logging.Warn(newClient).Log(logging.MessageKey(), "Advertised service has no handler", "service", service)
+	}
 
 	return newClient, nil
 }
 
+// connect runs discovery, dials the websocket and starts the ping handler and
+// read loop for the new connection, which replaces any previous one
+func (c *client) connect(ctx context.Context) error {
+	return c.connectTo(ctx, "", nil)
+}
+
+// connectTo dials the websocket at backendURL directly, skipping discovery,
+// unless backendURL is empty. extra headers are added to the handshake.
+func (c *client) connectTo(ctx context.Context, backendURL string, extra http.Header) error {
+	headerInfo := c.headerInfo
+	if len(extra) > 0 {
+		withExtra := *headerInfo
+		withExtra.extra = extra
+		headerInfo = &withExtra
+	}
+
+	var (
+		newConnection *websocket.Conn
+		connectionURL string
+		handshake     *http.Response
+		err           error
+	)
+
+	if c.adoptedConn != nil {
+		connectionURL = c.adoptedURL
+		newConnection, handshake, err = upgradeConnection(ctx, c.adoptedConn, connectionURL, headerInfo, &c.factory)
+		c.adoptedConn = nil
+	} else if backendURL != "" {
+		connectionURL = backendURL
+		newConnection, handshake, err = dialBackend(ctx, backendURL, headerInfo, &c.factory, c.Logger)
+	} else {
+		newConnection, connectionURL, handshake, err = createConnection(ctx, headerInfo, &c.factory, c.Logger)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		newConnection.Close()
+		return err
+	}
+
+	// at this point we know that the URL connection is legitimate, so we can do some string manipulation
+	// with the knowledge that `:` will be found in the string twice
+	//connectionURL = connectionURL[len("ws://"):strings.LastIndex(connectionURL, ":")]
+	readDone := make(chan struct{})
+	myPingMissHandler, err := c.install(newConnection, connectionURL, readDone)
+	if err != nil {
+		return err
+	}
+
+	var sessionID string
+	if c.factory.SessionIDHeader != "" && handshake != nil {
+		sessionID = handshake.Header.Get(c.factory.SessionIDHeader)
+	}
+	c.sessionID.Store(sessionID)
+
+	c.goroutine(func() {
+		c.readFrom(newConnection)
+		if owner := c.owner(); owner != nil {
+			owner.markLost(newConnection)
+		}
+		close(readDone)
+	})
+
+	if c.factory.HandshakeChallenge != nil {
+		if err = c.answerChallenge(handshake); err != nil {
+			logging.Error(c).Log(logging.MessageKey(), "Failed to answer the handshake challenge, dropping the connection", logging.ErrorKey(), err)
+			myPingMissHandler.stopPingHandler()
+			<-myPingMissHandler.done
+			return fmt.Errorf("HandshakeChallenge: %w", err)
+		}
+	}
+
+	if c.factory.VerifyOnConnect {
+		if err = c.verifyConnection(ctx, myPingMissHandler); err != nil {
+			logging.Error(c).Log(logging.MessageKey(), "Connection failed its verification, dropping it", logging.ErrorKey(), err)
+			myPingMissHandler.stopPingHandler()
+			<-myPingMissHandler.done
+			return err
+		}
+	}
+
+	if c.factory.OnConnect != nil {
+		if err = c.factory.OnConnect(c); err != nil {
+			logging.Error(c).Log(logging.MessageKey(), "OnConnect failed, dropping the connection", logging.ErrorKey(), err)
+			myPingMissHandler.stopPingHandler()
+			<-myPingMissHandler.done
+			return fmt.Errorf("OnConnect: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// newConnectionID returns a short random id for a new connection
+func newConnectionID() string {
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// answerChallenge sends the message HandshakeChallenge makes out of the
+// handshake response, if any
+func (c *client) answerChallenge(handshake *http.Response) error {
+	firstMessage, err := c.factory.HandshakeChallenge(handshake)
+	if err != nil || firstMessage == nil {
+		return err
+	}
+	return c.Send(firstMessage)
+}
+
+// install makes newConnection the client's connection and starts its ping
+// handler. readDone must be closed once the read loop of the connection is
+// over.
+func (c *client) install(newConnection *websocket.Conn, connectionURL string, readDone <-chan struct{}) (*pingHandler, error) {
+	myPingMissHandler := &pingHandler{
+		conn:             newConnection,
+		handlePingMiss:   c.factory.HandlePingMiss,
+		onPingSent:       c.factory.OnPingSent,
+		onPong:           c.factory.OnPong,
+		stop:             make(chan bool),
+		done:             make(chan struct{}),
+		readDone:         readDone,
+		closeGracePeriod: c.factory.closeGracePeriod(),
+		maxAge:           c.factory.MaxConnectionAge,
+		clock:            c.clock(),
+		Logger:           c.Logger,
+	}
+
+	newConnection.SetReadLimit(c.factory.readLimit())
+	c.factory.extendReadDeadline(newConnection)
+	newConnection.SetPongHandler(func(appData string) error {
+		c.factory.extendReadDeadline(newConnection)
+		c.markPong()
+		myPingMissHandler.pongReceived(appData)
+		if c.factory.OnPongReceived != nil {
+			c.factory.OnPongReceived(appData)
+		}
+		return nil
+	})
+
+	var secure int32
+	if isSecure(newConnection, connectionURL) {
+		secure = 1
+	}
+	atomic.StoreInt32(&c.secure, secure)
+
+	c.writeLock.Lock()
+	if c.closing() {
+		// Close ran while this connection was being made; it has already
+		// looked for a ping handler to stop, so this one must not be installed
+		c.writeLock.Unlock()
+		newConnection.Close()
+		return nil, ErrClientClosed
+	}
+
+	c.hostname.Store(connectionURL)
+	c.subprotocol.Store(newConnection.Subprotocol())
+	c.connectionID.Store(newConnectionID())
+	c.connection = newConnection
+	c.pingHandler = myPingMissHandler
+	c.writeLock.Unlock()
+
+	c.markConnected(true)
+
+	c.goroutine(func() { myPingMissHandler.checkPing(c) })
+	return myPingMissHandler, nil
+}
+
+// isSecure tells whether the websocket runs over TLS, looking at the connection
+// itself first since a custom dial may have set it up regardless of the url
+func isSecure(connection *websocket.Conn, wsURL string) bool {
+	if _, ok := connection.UnderlyingConn().(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(wsURL), "wss://")
+}
+
+// deviceScheme returns the scheme of a parsed device id, such as mac or uuid
+func deviceScheme(id device.ID) string {
+	value := string(id)
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		return value[:i]
+	}
+	return ""
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLimit translates MaxMessageSize into the value expected by SetReadLimit,
+// where zero means no limit at all
+func (f *ClientFactory) readLimit() int64 {
+	switch {
+	case f.MaxMessageSize == 0:
+		return maxMessageSize
+	case f.MaxMessageSize < 0:
+		return 0
+	default:
+		return f.MaxMessageSize
+	}
+}
+
+// readDeadline returns how long a read may wait for data, where zero means
+// forever
+func (f *ClientFactory) readDeadline() time.Duration {
+	switch {
+	case f.ReadDeadline == 0:
+		return pongWait
+	case f.ReadDeadline < 0:
+		return 0
+	default:
+		return f.ReadDeadline
+	}
+}
+
+// pingPeriod returns how often the server is pinged to begin with
+func (f *ClientFactory) pingPeriod() time.Duration {
+	switch readDeadline := f.readDeadline(); {
+	case f.PingPeriod > 0:
+		return f.PingPeriod
+	case readDeadline > 0:
+		return (readDeadline * 9) / 10
+	default:
+		return pingPeriod
+	}
+}
+
+// extendReadDeadline pushes back the read deadline of conn by readDeadline
+func (f *ClientFactory) extendReadDeadline(conn *websocket.Conn) {
+	if d := f.readDeadline(); d > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+func (f *ClientFactory) closeGracePeriod() time.Duration {
+	if f.CloseGracePeriod > 0 {
+		return f.CloseGracePeriod
+	}
+	return closeGracePeriod
+}
+
 // HandlePingMiss is a function called when we run into situations where we're not getting anymore pings
 // the implementation of this function needs to be handled by the user of kratos
 type HandlePingMiss func() error
@@ -119,32 +854,161 @@ type pingHandler struct {
 	conn           *websocket.Conn
 	handlePingMiss HandlePingMiss
 	log.Logger
-	stop chan bool
+	stop     chan bool
+	stopOnce sync.Once
+
+	// closed once checkPing has returned and the connection is closed
+	done chan struct{}
+
+	// closed once the read loop for conn has returned
+	readDone         <-chan struct{}
+	closeGracePeriod time.Duration
+
+	maxAge time.Duration
+
+	onPingSent func()
+
+	// set when the connection is exported, to be left open
+	released int32
+
+	// each ping carries a sequence number so its pong can be matched to the
+	// time it was sent
+	onPong     func(rtt time.Duration)
+	clock      clock
+	pingLock   sync.Mutex
+	pingID     uint64
+	pingSentAt time.Time
+
+	// closed once the pong of the ping with pongWaitID comes back
+	pongWait   chan struct{}
+	pongWaitID string
+}
+
+// sendPing writes the next ping, remembering when it went out, and calls
+// handlePingMiss when it can't. pong, unless nil, is closed once the pong of
+// this ping comes back.
+func (pmh *pingHandler) sendPing(inClient *client, pong chan struct{}) error {
+	pmh.pingLock.Lock()
+	pmh.pingID++
+	appData := strconv.FormatUint(pmh.pingID, 10)
+	pmh.pingSentAt = clockOr(pmh.clock).Now()
+	if pong != nil {
+		pmh.pongWait, pmh.pongWaitID = pong, appData
+	}
+	pmh.pingLock.Unlock()
+
+	inClient.writeLock.Lock()
+	pmh.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err := pmh.conn.WriteMessage(websocket.PingMessage, []byte(appData))
+	inClient.writeLock.Unlock()
+
+	if err != nil && pmh.handlePingMiss != nil {
+		pmh.handlePingMiss()
+	}
+	if err == nil && pmh.onPingSent != nil {
+		pmh.onPingSent()
+	}
+	return err
+}
+
+// pongReceived reports the round trip time of the latest ping when appData
+// says the pong answers it, and ends the wait for the pong of a ping sent
+// with one
+func (pmh *pingHandler) pongReceived(appData string) {
+	pmh.pingLock.Lock()
+	if pmh.pongWait != nil && appData == pmh.pongWaitID {
+		close(pmh.pongWait)
+		pmh.pongWait = nil
+	}
+	matches := appData == strconv.FormatUint(pmh.pingID, 10)
+	rtt := clockOr(pmh.clock).Now().Sub(pmh.pingSentAt)
+	pmh.pingLock.Unlock()
+
+	if matches && pmh.onPong != nil {
+		pmh.onPong(rtt)
+	}
 }
 
 func (pmh *pingHandler) stopPingHandler() {
-	pmh.stop <- true
+	pmh.stopOnce.Do(func() { close(pmh.stop) })
+}
+
+// releasePingHandler stops the ping handler, leaving the connection open
+func (pmh *pingHandler) releasePingHandler() {
+	atomic.StoreInt32(&pmh.released, 1)
+	pmh.stopPingHandler()
 }
 
 func (pmh *pingHandler) checkPing(inClient *client) {
-	pingTimer := time.NewTimer(pingPeriod)
+	if pmh.conn == nil {
+		// there is no connection to ping or close
+		close(pmh.done)
+		return
+	}
+
+	clock := inClient.clock()
+	pingTimer := clock.NewTimer(inClient.currentPingPeriod())
 	defer func() {
 		pingTimer.Stop()
-		pmh.conn.Close()
-		close(pmh.stop)
+		if atomic.LoadInt32(&pmh.released) == 0 {
+			pmh.conn.Close()
+		}
+		close(pmh.done)
 	}()
 
+	watch := newClockWatch(clock)
+
+	var ageExpired <-chan time.Time
+	if pmh.maxAge > 0 {
+		ageTimer := clock.NewTimer(jitterAge(pmh.maxAge))
+		defer ageTimer.Stop()
+		ageExpired = ageTimer.C()
+	}
+
 	for {
 		select {
 		case <-pmh.stop:
 			logging.Info(pmh).Log(logging.MessageKey(), "Stopping ping handler!")
-			pmh.conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		case <-pingTimer.C:
+			if atomic.LoadInt32(&pmh.released) == 1 {
+				return
+			}
+
+			inClient.writeLock.Lock()
 			pmh.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := pmh.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			err := pmh.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			inClient.writeLock.Unlock()
+
+			if err != nil {
+				// the connection is broken, no answer will come
+				return
+			}
+
+			// the server answers with its own close frame, which ends the read
+			// loop, but don't wait on an unresponsive server for too long
+			grace := clock.NewTimer(pmh.closeGracePeriod)
+			select {
+			case <-pmh.readDone:
+			case <-grace.C():
+			}
+			grace.Stop()
+			return
+		case <-pingTimer.C():
+			if jump := watch.observe(); jump != 0 {
+				logging.Warn(pmh).Log(logging.MessageKey(), "The wall clock jumped, deadlines are kept on the monotonic clock",
+					"jump", jump)
+			}
+
+			if err := pmh.sendPing(inClient, nil); err != nil {
+				logging.Error(pmh).Log(logging.MessageKey(), "Ping failed, reconnecting", logging.ErrorKey(), err)
+				inClient.reconnectFrom(pmh.conn, ReconnectPingMiss, err.Error(), 0)
 				return
 			}
+			// picks up any change made by SetPingPeriod
+			pingTimer.Reset(inClient.currentPingPeriod())
+		case <-ageExpired:
+			logging.Info(pmh).Log(logging.MessageKey(), "Connection reached its maximum age, reconnecting")
+			ageExpired = nil
+			inClient.startReconnect(ReconnectMaxAge, "", 0)
 		}
 	}
 }
@@ -152,13 +1016,152 @@ func (pmh *pingHandler) checkPing(inClient *client) {
 // Client is what function calls we expose to the user of kratos
 type Client interface {
 	Hostname() string
+
+	// IsSecure tells whether the current connection was established over TLS
+	IsSecure() bool
+
+	// Subprotocol is the websocket subprotocol negotiated with the server
+	Subprotocol() string
+
+	// ConnectionID is a random id of the current connection, telling the
+	// log lines of one connection from those of the next
+	ConnectionID() string
+
+	// GoroutineCount is how many goroutines the client has running
+	GoroutineCount() int
+
+	// LastCloseReason is the close code and reason of the last connection
+	// that ended with a close frame, or 0 and an empty string
+	LastCloseReason() (code int, reason string)
+
+	// UnderlyingConn is an escape hatch for advanced uses returning the
+	// gorilla connection currently in use, if there is one. It is replaced on
+	// every reconnect, and writing to it directly bypasses the write lock the
+	// client's own sends go through, so prefer the Client methods.
+	UnderlyingConn() (*websocket.Conn, bool)
+	DeviceScheme() string
+	// NewMessage starts building a message from this device
+	NewMessage() *MessageBuilder
 	Send(message interface{}) error
+
+	// SendWithDeadline is Send with its own write timeout
+	SendWithDeadline(d time.Duration, message interface{}) error
+
+	// TrySend is Send failing with ErrWouldBlock instead of waiting for the
+	// other messages to be written
+	TrySend(message interface{}) error
+
+	// SendMany sends msgs in order until one fails or ctx is done, telling
+	// how many were sent
+	SendMany(ctx context.Context, msgs []interface{}) (sent int, err error)
+
+	// SendSticky is Send for a message that is sent again after every
+	// reconnect, until another one is sent sticky to the same destination
+	SendSticky(destination string, message interface{}) error
+
+	// RegisterPayloadCodec sets how the payloads with contentType are decoded
+	// for a PayloadReadHandler
+	RegisterPayloadCodec(contentType string, decode func([]byte, interface{}) error)
+
+	// SendStream sends what is read from r in chunks, keeping memory bounded
+	// for large payloads
+	SendStream(destination string, r io.Reader, chunkSize int) error
+
+	// SendFile sends the content of the file at path, streamed in chunks
+	// when it's large
+	SendFile(destination, path, contentType string) error
+
+	// SendPriority is Send for a message that may jump ahead of the others
+	// waiting to be written
+	SendPriority(p Priority, message interface{}) error
+
+	// SendFrame is Send with an explicit websocket frame type, for servers
+	// that dispatch on the opcode rather than the WRP content
+	SendFrame(frameType int, message interface{}) error
+	SendEvent(destination string, payload []byte) error
+	SendWithResponse(ctx context.Context, message wrp.Message, options ...RequestOption) (wrp.Message, error)
+
+	// SendConfirmed is Send waiting for the server to confirm that it
+	// processed the message rather than only for the write to complete
+	SendConfirmed(ctx context.Context, message wrp.Message, options ...RequestOption) error
+
+	// OnAck calls fn the first time a message with transactionUUID is received
+	OnAck(transactionUUID string, fn func())
 	Close() error
+
+	// CloseCtx is Close, giving up on a clean shutdown once ctx is done
+	CloseCtx(ctx context.Context) error
+
+	// PauseDispatch holds the messages read instead of handing them to the
+	// handlers, until ResumeDispatch
+	PauseDispatch()
+
+	// ResumeDispatch hands the messages held to the handlers and goes back
+	// to handing them as they are read
+	ResumeDispatch()
+
+	// ForPartner returns a Client sharing this connection whose messages
+	// all carry partnerID
+	ForPartner(partnerID string) Client
+
+	// CloseWithReport is CloseCtx, also reporting the messages left
+	// unprocessed or unsent
+	CloseWithReport(ctx context.Context) (CloseReport, error)
+
+	// CloseDrain is CloseCtx, also waiting for the messages already read to
+	// be handled
+	CloseDrain(ctx context.Context) error
+
+	// ExportConnection is Close, except that the connection is left open to
+	// be adopted by another client with NewWithConnection
+	ExportConnection() (*ExportedConnection, error)
+
+	// SendAndClose sends message and then closes the client, for one-shot use
+	SendAndClose(ctx context.Context, message interface{}) error
+
+	// QueueDepth is the number of sends that are either waiting for their
+	// turn on the connection or currently being written
+	QueueDepth() int
+
+	// SetPingPeriod changes how often the server is pinged, starting after the
+	// next ping
+	SetPingPeriod(d time.Duration) error
+
+	// ReconnectHistory returns the last reconnect attempts, oldest first
+	ReconnectHistory() []ReconnectEvent
+
+	// RecentMessages returns the last messages received, oldest first
+	RecentMessages() []wrp.Message
+
+	// AnalyzeHandlers reports the handlers matching the same destinations
+	AnalyzeHandlers() []HandlerConflict
+
+	// WouldMatch returns the keys of the handlers a message to destination
+	// would be given to, without dispatching anything
+	WouldMatch(destination string) []string
+
+	// RegisterHandler adds a handler to those of the client, kept across
+	// reconnects
+	RegisterHandler(h HandlerRegistry) error
+
+	// DeregisterHandler removes the handlers registered with handlerKey and
+	// tells whether there was any
+	DeregisterHandler(handlerKey string) bool
+
+	// Stats returns a snapshot of what the client is holding on to
+	Stats() Stats
+
+	// Healthy tells whether the client is in a good state, and why not if it isn't
+	Healthy() (bool, string)
+
+	// InflightRequests is the number of SendWithResponse calls still waiting
+	// on the server's response
+	InflightRequests() int
 }
 
 type websocketConnection interface {
 	WriteMessage(messageType int, data []byte) error
-	ReadMessage() (messageType int, p []byte, err error)
+	NextReader() (messageType int, r io.Reader, err error)
 	Close() error
 }
 
@@ -168,113 +1171,1050 @@ type ReadHandler interface {
 	HandleMessage(msg interface{})
 }
 
+// RawReadHandler can be implemented by a ReadHandler that also needs the
+// websocket frame type and the bytes a message was decoded from, for instance
+// to forward it verbatim without encoding it again. HandleRaw is then called
+// instead of HandleMessage, except for messages decoded with DecodeInto.
+type RawReadHandler interface {
+	ReadHandler
+	HandleRaw(frameType int, raw []byte, msg wrp.Message)
+}
+
 // HandlerRegistry is an internal data type for Client interface
 // that helps keep track of registered handler functions
 type HandlerRegistry struct {
 	HandlerKey string
-	keyRegex   *regexp.Regexp
+	keyMatch   keyMatcher
 	Handler    ReadHandler
+
+	// HeaderMatch, when set, also routes to Handler the messages whose WRP
+	// Headers it accepts, whether or not their destination matches
+	// HandlerKey. HandlerKey may be left empty to route on headers alone.
+	HeaderMatch func(headers []string) bool
+
+	// SourceKey, when set, is a regular expression the WRP Source of a
+	// message must match as well as its destination matching HandlerKey, or
+	// instead of it when SourceOr is set. Leave HandlerKey empty to route on
+	// the source alone.
+	SourceKey   string
+	sourceRegex *regexp.Regexp
+	SourceOr    bool
+
+	// MaxConcurrency, when positive, runs Handler in its own goroutines, at
+	// most this many at a time, so that a burst on one route doesn't hold up
+	// the others. Once they are all busy the read loop waits for one to be
+	// done, or drops the message when DropWhenBusy is set.
+	MaxConcurrency int
+	DropWhenBusy   bool
+	slots          chan struct{}
+
+	// Priority orders the handlers matching a message: those with a higher
+	// Priority are called first, and handlers of the same Priority are called
+	// in the order they were registered.
+	Priority int
+}
+
+// matches tells whether msg should be handed to the registry's handler
+func (h *HandlerRegistry) matches(msg *wrp.Message) bool {
+	matched := h.keyMatch != nil && h.keyMatch.MatchString(msg.Destination)
+	if h.sourceRegex != nil {
+		if h.SourceOr {
+			matched = matched || h.sourceRegex.MatchString(msg.Source)
+		} else {
+			matched = matched && h.sourceRegex.MatchString(msg.Source)
+		}
+	}
+
+	if matched {
+		return true
+	}
+	return h.HeaderMatch != nil && h.HeaderMatch(msg.Headers)
+}
+
+// HasHeader returns a HeaderMatch accepting the messages that carry header
+func HasHeader(header string) func([]string) bool {
+	return func(headers []string) bool {
+		for _, h := range headers {
+			if h == header {
+				return true
+			}
+		}
+		return false
+	}
 }
 
 type client struct {
+	// accessed atomically, kept first so that it is 64-bit aligned on 32-bit
+	// platforms
+	bufferedBytes int64
+	pingPeriod    int64 // time.Duration, zero uses the default
+
 	deviceID        string
+	deviceScheme    string
 	userAgent       string
 	deviceProtocols string
-	hostname        string
-	handlers        []HandlerRegistry
+	hostname        atomic.Value // string, replaced on every reconnect
+	subprotocol     atomic.Value // string, negotiated on every reconnect
+	connectionID    atomic.Value // string, generated on every reconnect
+	sessionID       atomic.Value // string, read from every handshake
+	lastClose       atomic.Value // *websocket.CloseError, the last one read
+	secure          int32
+	handlers        []HandlerRegistry // replaced, never changed, see registeredHandlers
+	handlersLock    sync.RWMutex
 	connection      websocketConnection
 	headerInfo      *clientHeader
-	pingHandler     pingHandler
+	pingHandler     *pingHandler
+	factory         ClientFactory
 	log.Logger
-}
 
-// used to track everything that we want to know about the client headers
-type clientHeader struct {
-	deviceName   string
-	firmwareName string
-	modelName    string
-	manufacturer string
-}
+	// set by NewWithConn and used by the first connect only
+	adoptedConn net.Conn
+	adoptedURL  string
 
-func (c *client) Hostname() string {
-	return c.hostname
-}
+	// closed by Close so that a pending reconnect gives up
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 
-// used to open a channel for writing to servers
-func (c *client) Send(message interface{}) (err error) {
-	logging.Info(c).Log(logging.MessageKey(), "Sending message...")
+	// writes to a websocket must not happen concurrently, messages first
+	// wait their turn in the sendQueue
+	writeLock     sync.Mutex
+	sendQueue     sendQueue
+	pendingWrites int32
 
-	var buffer bytes.Buffer
+	// how many goroutines the client has running
+	goroutines int32
 
-	if err = wrp.NewEncoder(&buffer, wrp.Msgpack).Encode(message); err == nil {
-		err = c.connection.WriteMessage(websocket.BinaryMessage, buffer.Bytes())
-	}
-	return
-}
+	// how many messages were read off the connection and not handed to the
+	// handlers yet
+	unprocessed int32
 
-// will close the connection to the server
-func (c *client) Close() (err error) {
+	// the messages held by PauseDispatch
+	pause dispatchPause
+
+	healthLock sync.Mutex
+	health     health
+
+	// nil unless RecentMessageBuffer is set
+	recent *ring
+
+	// nil unless ReconnectHistorySize is set
+	reconnects *ring
+
+	// the reconnect attempts counted against the ReconnectBudget
+	budget reconnectBudget
+
+	// closed once the reconnect running is over, nil when there is none
+	reconnectLock sync.Mutex
+	reconnecting  chan struct{}
+
+	// set by CloseDrain to stop taking new messages, which then waits for
+	// the handlers of those already read
+	draining int32
+	handling sync.WaitGroup
+
+	// set by ExportConnection, telling where the connection went
+	handover atomic.Value // *ExportedConnection
+
+	// the last message given to SendSticky for each destination
+	stickyLock sync.Mutex
+	sticky     map[string]interface{}
+
+	// the decoders given to RegisterPayloadCodec by content type
+	codecLock sync.RWMutex
+	codecs    map[string]func([]byte, interface{}) error
+
+	transactionsLock sync.RWMutex
+	transactions     map[string]*transaction
+	acks             map[string]func()
+
+	// one per SendWithResponse call in flight, nil without MaxInflightRequests
+	inflightSlots chan struct{}
+}
+
+// used to track everything that we want to know about the client headers
+type clientHeader struct {
+	deviceName   string
+	firmwareName string
+	modelName    string
+	manufacturer string
+	bootTime     time.Time
+	services     []string
+
+	// the header carrying deviceName, defaultDeviceNameHeader when empty
+	deviceNameHeader string
+
+	// headers added to those of the device for a single handshake
+	extra http.Header
+}
+
+// used as the boot time of devices that don't have one of their own
+var processStart = time.Now()
+
+func (c *client) Hostname() string {
+	hostname, _ := c.hostname.Load().(string)
+	return hostname
+}
+
+// ConnectionID identifies the current connection, a new one being generated
+// on every reconnect. It's logged by the client as connectionID.
+func (c *client) ConnectionID() string {
+	connectionID, _ := c.connectionID.Load().(string)
+	return connectionID
+}
+
+// LastCloseReason is the close code and reason of the last connection that
+// ended with a close frame, telling a clean disconnect, such as "1000:
+// normal", from a fault. It's 0 and an empty string until then. Connections
+// dropped without a close frame are reported by gorilla with the abnormal
+// closure code 1006.
+func (c *client) LastCloseReason() (code int, reason string) {
+	if closeErr, ok := c.lastClose.Load().(*websocket.CloseError); ok {
+		return closeErr.Code, closeErr.Text
+	}
+	return 0, ""
+}
+
+// Subprotocol is the websocket subprotocol the server selected out of the
+// Subprotocols, or an empty string when none was
+func (c *client) Subprotocol() string {
+	subprotocol, _ := c.subprotocol.Load().(string)
+	return subprotocol
+}
+
+// UnderlyingConn returns the gorilla connection in use, if there is one
+func (c *client) UnderlyingConn() (*websocket.Conn, bool) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	conn, ok := c.connection.(*websocket.Conn)
+	return conn, ok && conn != nil
+}
+
+func (c *client) IsSecure() bool {
+	return atomic.LoadInt32(&c.secure) == 1
+}
+
+// DeviceScheme is the scheme of the device id, such as mac, uuid, serial or dns
+func (c *client) DeviceScheme() string {
+	return c.deviceScheme
+}
+
+// used to open a channel for writing to servers
+func (c *client) Send(message interface{}) error {
+	return c.SendFrame(websocket.BinaryMessage, message)
+}
+
+// SendFrame encodes message as Msgpack like Send, but writes it in a frame of
+// frameType, which must be websocket.BinaryMessage or websocket.TextMessage
+func (c *client) SendFrame(frameType int, message interface{}) error {
+	return c.send(frameType, sendOptions{}, message)
+}
+
+// SendWithDeadline is Send giving up on the write after d rather than the
+// usual 10 seconds, tighter for latency sensitive messages or looser for
+// large ones. The deadline only applies to this message.
+func (c *client) SendWithDeadline(d time.Duration, message interface{}) error {
+	return c.send(websocket.BinaryMessage, sendOptions{wait: d}, message)
+}
+
+// TrySend is Send for callers that would rather drop or coalesce a message
+// than wait: it fails right away with ErrWouldBlock when other messages are
+// waiting to be written or being written. It may still wait on a ping or close
+// frame being written.
+func (c *client) TrySend(message interface{}) error {
+	return c.send(websocket.BinaryMessage, sendOptions{noWait: true}, message)
+}
+
+// SendMany sends msgs in order until they are all sent, one of them fails or
+// ctx is done, returning how many were sent so that a caller can resume from
+// there. A deadline of ctx bounds each write. The error tells the index of the
+// message that wasn't sent and wraps why.
+func (c *client) SendMany(ctx context.Context, msgs []interface{}) (sent int, err error) {
+	for i, message := range msgs {
+		if err = ctx.Err(); err == nil {
+			options := sendOptions{}
+			if deadline, ok := ctx.Deadline(); ok {
+				options.wait = time.Until(deadline)
+			}
+			err = c.send(websocket.BinaryMessage, options, message)
+		}
+
+		if err != nil {
+			return i, fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+
+	return len(msgs), nil
+}
+
+// sendOptions are how a single message is sent
+type sendOptions struct {
+	priority Priority
+
+	// how long the write may take, writeWait when it isn't positive
+	wait time.Duration
+
+	// fail with ErrWouldBlock rather than wait for other messages
+	noWait bool
+}
+
+// send encodes and writes message
+func (c *client) send(frameType int, options sendOptions, message interface{}) (err error) {
+	if c.factory.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if frameType != websocket.BinaryMessage && frameType != websocket.TextMessage {
+		return fmt.Errorf("%w: %d", ErrInvalidFrameType, frameType)
+	}
+
+	logging.Info(c).Log(logging.MessageKey(), "Sending message...")
+
+	buffer := sendBuffers.Get().(*sendBuffer)
+	defer sendBuffers.Put(buffer)
+	buffer.Reset()
+
+	if err = buffer.encoder.Encode(message); err != nil {
+		return
+	}
+
+	if version := c.factory.wrpVersion(); c.factory.ValidateOutbound || version != WRPVersion2 {
+		if err = validateEncoded(buffer.Bytes(), c.factory.ValidateOutbound, version); err != nil {
+			return
+		}
+	}
+
+	// WriteMessage copies the data out before returning, so the buffer
+	// can go back to the pool afterwards
+	return c.write(frameType, options, buffer.Bytes())
+}
+
+// sendBuffer is a reusable buffer along with a msgpack encoder writing to it
+type sendBuffer struct {
+	bytes.Buffer
+	encoder wrp.Encoder
+}
+
+var sendBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := new(sendBuffer)
+		buffer.encoder = wrp.NewEncoder(&buffer.Buffer, wrp.Msgpack)
+		return buffer
+	},
+}
+
+// shared by the dialers of every client so idle connections don't each hold
+// on to a write buffer
+var writeBufferPool = new(sync.Pool)
+
+// SendEvent sends a fire-and-forget WRP event from this device to destination
+func (c *client) SendEvent(destination string, payload []byte) error {
+	return c.Send(wrp.SimpleEvent{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      c.deviceID,
+		Destination: destination,
+		Payload:     payload,
+	})
+}
+
+// write serializes all outgoing frames so they never interleave on the
+// connection. Each frame sets its own write deadline so none is left over from
+// an earlier write.
+func (c *client) write(messageType int, options sendOptions, data []byte) error {
+	size := int64(len(data))
+	if limit := c.factory.MaxSendMessageSize; limit > 0 && size > limit {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, size, limit)
+	}
+
+	if err := c.reserveBuffer(size); err != nil {
+		return err
+	}
+	defer c.releaseBuffer(size)
+
+	atomic.AddInt32(&c.pendingWrites, 1)
+	defer atomic.AddInt32(&c.pendingWrites, -1)
+
+	wait := options.wait
+	if wait <= 0 && c.factory.WriteDeadlineFunc != nil {
+		wait = c.factory.WriteDeadlineFunc(len(data))
+	}
+	if wait <= 0 {
+		wait = writeWait
+	}
+
+	failed, err := c.writeTurn(messageType, options, wait, data)
+	if failed == nil {
+		return err
+	}
+
+	// gorilla fails every later write on a connection once one has failed
+	if c.factory.WriteRetry && isTemporary(err) {
+		logging.Warn(c).Log(logging.MessageKey(), "Write failed temporarily, retrying it on a new connection", logging.ErrorKey(), err)
+
+		if c.awaitReconnect(failed, ReconnectWriteError, err.Error(), wait) {
+			_, err = c.writeTurn(messageType, options, wait, data)
+		}
+		return err
+	}
+
+	logging.Error(c).Log(logging.MessageKey(), "Write failed, reconnecting", logging.ErrorKey(), err)
+	c.reconnectFrom(failed, ReconnectWriteError, err.Error(), 0)
+	return err
+}
+
+// writeTurn waits for the turn of the message in the sendQueue and writes it
+// to the connection. When the connection fails the write, it is returned
+// along with the error.
+func (c *client) writeTurn(messageType int, options sendOptions, wait time.Duration, data []byte) (websocketConnection, error) {
+	if options.noWait {
+		if !c.sendQueue.tryAcquire() {
+			return nil, ErrWouldBlock
+		}
+	} else {
+		c.sendQueue.acquire(options.priority)
+	}
+	defer c.sendQueue.release()
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.connection == nil {
+		return nil, ErrNotConnected
+	}
+
+	c.setWriteDeadline(wait)
+	c.setWriteCompression(len(data))
+	if err := c.connection.WriteMessage(messageType, data); err != nil {
+		return c.connection, err
+	}
+	return nil, nil
+}
+
+// setWriteCompression compresses the next write on the connection when it is
+// at least CompressionMinSize long, which only has an effect if the server
+// agreed to per-message deflate. The caller holds the writeLock.
+func (c *client) setWriteCompression(size int) {
+	if c.factory.CompressionMinSize <= 0 {
+		return
+	}
+
+	if compressor, ok := c.connection.(interface{ EnableWriteCompression(bool) }); ok {
+		compressor.EnableWriteCompression(size >= c.factory.CompressionMinSize)
+	}
+}
+
+// setWriteDeadline gives the next write on the connection wait to complete.
+// The caller holds the writeLock.
+func (c *client) setWriteDeadline(wait time.Duration) {
+	if deadliner, ok := c.connection.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		_ = deadliner.SetWriteDeadline(time.Now().Add(wait))
+	}
+}
+
+// isTemporary tells whether a write error, such as a timeout, may not happen
+// again on the same connection
+func isTemporary(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary())
+}
+
+func (c *client) QueueDepth() int {
+	return int(atomic.LoadInt32(&c.pendingWrites))
+}
+
+// SetPingPeriod changes how often the server is pinged without reconnecting,
+// for instance to detect failures sooner on a flaky network. The new period is
+// used from the next ping on and must be positive and shorter than both the
+// read deadline, which pongs push back, and HealthThresholds.MaxPongAge, the
+// same way New checks the period it starts with.
+func (c *client) SetPingPeriod(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%w: %s must be positive", ErrInvalidPingPeriod, d)
+	}
+
+	if readDeadline := c.factory.readDeadline(); readDeadline > 0 && d >= readDeadline {
+		return fmt.Errorf("%w: %s must be shorter than the read deadline %s since pongs push it back", ErrInvalidPingPeriod, d, readDeadline)
+	}
+
+	if maxPongAge := c.factory.HealthThresholds.MaxPongAge; maxPongAge > 0 && d >= maxPongAge {
+		return fmt.Errorf("%w: %s must be shorter than HealthThresholds.MaxPongAge %s", ErrInvalidPingPeriod, d, maxPongAge)
+	}
+
+	atomic.StoreInt64(&c.pingPeriod, int64(d))
+	return nil
+}
+
+func (c *client) currentPingPeriod() time.Duration {
+	if d := atomic.LoadInt64(&c.pingPeriod); d > 0 {
+		return time.Duration(d)
+	}
+	return c.factory.pingPeriod()
+}
+
+// closing tells whether Close has been called
+func (c *client) closing() bool {
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// will close the connection to the server
+func (c *client) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// CloseCtx is Close bounded by ctx. Should ctx be done before the client has
+// shut down, the connection is dropped without waiting any longer and
+// ctx.Err() is returned.
+func (c *client) CloseCtx(ctx context.Context) (err error) {
 	logging.Info(c).Log("Closing client...")
-	c.pingHandler.stopPingHandler()
+	c.shutdownOnce.Do(func() { close(c.shutdown) })
+	c.abandonTransactions(ErrClientClosed)
+
+	c.writeLock.Lock()
+	pingHandler := c.pingHandler
+	connection := c.connection
+	c.writeLock.Unlock()
+
+	if pingHandler == nil {
+		// the client never finished connecting, there is at most a
+		// connection to drop
+		if connection != nil {
+			err = connection.Close()
+		}
+		return
+	}
+
+	pingHandler.stopPingHandler()
+	select {
+	case <-pingHandler.done:
+	case <-ctx.Done():
+		if connection != nil {
+			connection.Close()
+		}
+		err = ctx.Err()
+	}
+	return
+}
+
+// SendAndClose sends message and closes the client once it is written. When
+// message is a request, a wrp.Message of SimpleRequestResponseMessageType with
+// a TransactionUUID, the close waits for the server's response or for ctx to
+// be done. The close itself is bounded by ctx, as with CloseCtx. The first
+// error from either the send or the close is returned.
+func (c *client) SendAndClose(ctx context.Context, message interface{}) (err error) {
+	if err = ctx.Err(); err == nil {
+		if msg, ok := message.(wrp.Message); ok && msg.Type == wrp.SimpleRequestResponseMessageType && msg.TransactionUUID != "" {
+			_, err = c.SendWithResponse(ctx, msg)
+		} else {
+			err = c.Send(message)
+		}
+	}
+
+	if closeErr := c.CloseCtx(ctx); err == nil {
+		err = closeErr
+	}
 	return
 }
 
 // going to be used to access the HandleMessage() function
-func (c *client) read() (err error) {
+//
+// read tells two kinds of errors apart. A read error means the connection is
+// no good anymore: the loop ends and handleReadError decides whether to
+// reconnect. A decode error only means one message is bad: the loop goes on
+// with the next message when SkipUndecodableMessages is set and ends otherwise.
+func (c *client) read() error {
+	return c.readFrom(c.connection)
+}
+
+// readFrom is read for connection, which may already have been replaced or
+// exported by the time the loop starts
+func (c *client) readFrom(connection websocketConnection) (err error) {
 	logging.Info(c).Log("Reading message...")
-	defer c.connection.Close()
+	if connection == nil {
+		return ErrNotConnected
+	}
+	defer connection.Close()
+
+	// the decoder is reset onto every new message instead of allocating one each time
+	var decoder wrp.Decoder
+
+	if c.factory.ReadBatchSize > 1 {
+		return c.readBatches(connection, c.factory.ReadBatchSize, &decoder)
+	}
 
 	for {
-		var serverMessage []byte
-		_, serverMessage, err = c.connection.ReadMessage()
+		// NextReader hands back a reader over the next message, continuation
+		// frames included, which is read whole below and only then decoded
+		var (
+			frameType     int
+			serverMessage io.Reader
+		)
+		frameType, serverMessage, err = connection.NextReader()
+
+		// the message belongs to whichever client has the connection now
+		owner := c.owner()
+		if owner == nil {
+			// the connection was exported and then dropped
+			return
+		}
+
 		if err != nil {
+			owner.handleReadError(connection, err)
 			return
 		}
 
-		// decode the message so we can read it
-		wrpData := wrp.Message{}
-		err = wrp.NewDecoderBytes(serverMessage, wrp.Msgpack).Decode(&wrpData)
+		if owner.isDraining() {
+			continue
+		}
 
-		if err != nil {
+		owner.markMessage()
+
+		// the whole message is read before decoding so that a connection
+		// breaking mid-message, which ends the loop, is never mistaken for a
+		// message that doesn't decode, which may just be skipped
+		var raw []byte
+		if raw, err = ioutil.ReadAll(serverMessage); err != nil {
+			owner.handleReadError(connection, err)
 			return
 		}
 
-		for i := 0; i < len(c.handlers); i++ {
-			if c.handlers[i].keyRegex.MatchString(wrpData.Destination) {
-				c.handlers[i].Handler.HandleMessage(wrpData)
+		if err = owner.process(&decoder, frameType, raw); err != nil {
+			return
+		}
+	}
+}
+
+// process decodes raw, a whole message read off the connection, and hands it
+// to the handlers, unless dispatch is paused. An error is only returned when
+// reading must stop.
+func (c *client) process(decoder *wrp.Decoder, frameType int, raw []byte) error {
+	if c.hold(frameType, raw) {
+		return nil
+	}
+	return c.dispatchFrame(decoder, frameType, raw)
+}
+
+// dispatchFrame decodes raw and hands it to the handlers
+func (c *client) dispatchFrame(decoder *wrp.Decoder, frameType int, raw []byte) error {
+	if c.factory.RawHandler != nil {
+		c.factory.RawHandler(raw)
+		return nil
+	}
+
+	// decode the message so we can read it
+	if *decoder == nil {
+		*decoder = wrp.NewDecoderBytes(raw, wrp.Msgpack)
+	} else {
+		(*decoder).ResetBytes(raw)
+	}
+
+	if c.factory.DecodeInto != nil {
+		target := c.factory.DecodeInto()
+		if err := (*decoder).Decode(target); err != nil {
+			if c.skipDecodeError(err) {
+				return nil
+			}
+			return err
+		}
+
+		c.dispatchDecoded(target)
+		return nil
+	}
+
+	wrpData := wrp.Message{}
+	if err := (*decoder).Decode(&wrpData); err != nil {
+		if c.skipDecodeError(err) {
+			return nil
+		}
+		return err
+	}
+	stripVersion(&wrpData, c.factory.wrpVersion())
+
+	c.dispatch(wrpData, &frame{frameType: frameType, raw: raw})
+	return nil
+}
+
+// defaultHandlerKey names the DefaultHandler in logs and callbacks
+const defaultHandlerKey = "<default>"
+
+// handle calls handler with msg, through HandleRaw when it is a RawReadHandler
+// and the frame is known, HandlePayload when it is a PayloadReadHandler and
+// the payload decodes, or HandleMessageCtx when it is a ContextReadHandler.
+// When it runs past HandlerHardTimeout the client is considered wedged and
+// reconnects, though the handler itself can't be stopped and keeps its
+// goroutine.
+func (c *client) handle(handlerKey string, handler ReadHandler, msg interface{}, from *frame) {
+	if timeout := c.factory.HandlerHardTimeout; timeout > 0 {
+		timer := c.clock().AfterFunc(timeout, func() {
+			logging.Error(c).Log(logging.MessageKey(), "Handler exceeded its hard timeout, reconnecting",
+				"handlerKey", handlerKey, "timeout", timeout)
+
+			if c.factory.OnHandlerTimeout != nil {
+				c.factory.OnHandlerTimeout(handlerKey)
+			}
+
+			c.startReconnect(ReconnectHandlerTimeout, handlerKey, 0)
+		})
+		defer timer.Stop()
+	}
+
+	if rawHandler, ok := handler.(RawReadHandler); ok && from != nil {
+		if wrpData, ok := msg.(wrp.Message); ok {
+			rawHandler.HandleRaw(from.frameType, from.raw, wrpData)
+			return
+		}
+	}
+
+	if payloadHandler, ok := handler.(PayloadReadHandler); ok {
+		if wrpData, ok := msg.(wrp.Message); ok && c.handlePayload(payloadHandler, wrpData) {
+			return
+		}
+	}
+
+	if ctxHandler, ok := handler.(ContextReadHandler); ok {
+		ctxHandler.HandleMessageCtx(c.messageContext(msg), msg)
+		return
+	}
+
+	handler.HandleMessage(msg)
+}
+
+// handleRegistered calls the handler of h with msg, in a goroutine of its own
+// when h has a MaxConcurrency and MaxGoroutines isn't reached
+func (c *client) handleRegistered(h *HandlerRegistry, msg interface{}, from *frame) {
+	if h.slots == nil {
+		c.handle(h.HandlerKey, h.Handler, msg, from)
+		return
+	}
+
+	if h.DropWhenBusy {
+		select {
+		case h.slots <- struct{}{}:
+		default:
+			logging.Warn(c).Log(logging.MessageKey(), "Handler is busy, dropping message",
+				"handlerKey", h.HandlerKey, "maxConcurrency", cap(h.slots))
+			return
+		}
+	} else {
+		select {
+		case h.slots <- struct{}{}:
+		case <-c.shutdown:
+			return
+		}
+	}
+
+	c.handling.Add(1)
+	run := func() {
+		defer func() {
+			<-h.slots
+			c.handling.Done()
+		}()
+		c.handle(h.HandlerKey, h.Handler, msg, from)
+	}
+
+	if !c.tryGoroutine(run) {
+		// MaxGoroutines are running already
+		run()
+	}
+}
+
+// skipDecodeError logs a message that couldn't be decoded and tells whether
+// reading should go on with the next one
+func (c *client) skipDecodeError(err error) bool {
+	if c.factory.SkipUndecodableMessages {
+		logging.Warn(c).Log(logging.MessageKey(), "Skipping a message that couldn't be decoded", logging.ErrorKey(), err)
+		return true
+	}
+
+	logging.Error(c).Log(logging.MessageKey(), "Failed to decode message", logging.ErrorKey(), err)
+	return false
+}
+
+// frame is what a message was decoded from
+type frame struct {
+	frameType int
+	raw       []byte
+}
+
+// dispatch hands a received message to whoever is waiting for it, a request
+// waiting on its response or else the handlers. from is the frame it was
+// decoded from, if known.
+func (c *client) dispatch(wrpData wrp.Message, from *frame) {
+	c.factory.metrics().IncMessagesReceivedFor(destinationService(wrpData.Destination))
+	if c.recent != nil {
+		c.recent.add(wrpData)
+	}
+
+	if c.completeTransaction(wrpData) {
+		return
+	}
+
+	c.acknowledge(wrpData)
+	c.autoAck(wrpData)
+
+	matched := 0
+	handlers := c.registeredHandlers()
+	for i := range handlers {
+		if handlers[i].matches(&wrpData) {
+			c.handleRegistered(&handlers[i], wrpData, from)
+			matched++
+		}
+	}
+
+	if matched > 0 {
+		return
+	}
+
+	if c.factory.DefaultHandler != nil {
+		c.handle(defaultHandlerKey, c.factory.DefaultHandler, wrpData, from)
+	} else if c.factory.OnUnmatched != nil {
+		c.factory.OnUnmatched(wrpData)
+	}
+}
+
+// dispatchDecoded hands a message decoded into a DecodeInto target to the
+// handlers, which can only match on its destination when it has a To method
+func (c *client) dispatchDecoded(target interface{}) {
+	matched := 0
+	if routable, ok := target.(interface{ To() string }); ok {
+		destination := routable.To()
+		c.factory.metrics().IncMessagesReceivedFor(destinationService(destination))
+		handlers := c.registeredHandlers()
+		for i := range handlers {
+			if handlers[i].keyMatch != nil && handlers[i].keyMatch.MatchString(destination) {
+				c.handleRegistered(&handlers[i], target, nil)
+				matched++
 			}
 		}
 	}
+
+	if matched == 0 && c.factory.DefaultHandler != nil {
+		c.handle(defaultHandlerKey, c.factory.DefaultHandler, target, nil)
+	}
 }
 
 // private func used to generate the client that we're looking to produce
-func createConnection(headerInfo *clientHeader, httpURL string, crtFile string, keyFile string) (connection *websocket.Conn, wsURL string, err error) {
-	_, err = device.ParseID(headerInfo.deviceName)
+func createConnection(ctx context.Context, headerInfo *clientHeader, f *ClientFactory, logger log.Logger) (connection *websocket.Conn, wsURL string, handshake *http.Response, err error) {
+	release, err := f.acquireDial(ctx)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer release()
+
+	headers := deviceHeaders(headerInfo)
+
+	client, dialer, err := f.transport()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if wsURL, err = discoverAny(ctx, client, headerInfo, f, logger); err != nil {
+			return nil, "", nil, err
+		}
+
+		//Get url to which we are redirected and reconfigure it
+		var resp *http.Response
+		connection, resp, err = dial(ctx, dialer, wsURL, headers, f, logger)
+		if err == nil {
+			resp.Body.Close()
+			return connection, wsURL, resp, nil
+		}
+
+		if resp != nil {
+			// the handshake was refused, the backend may have said why
+			return nil, "", nil, createError(resp.StatusCode, readBody(resp), err)
+		}
+
+		// the backend couldn't be reached at all, it may have gone away since
+		// petasos picked it, so another one is asked for
+		if attempt == maxDiscoveryAttempts || ctx.Err() != nil {
+			return nil, "", nil, fmt.Errorf("dialing %s failed after %d discovery attempt(s): %w", wsURL, attempt, err)
+		}
+
+		logging.Warn(logger).Log(logging.MessageKey(), "Backend unreachable, asking petasos for another one",
+			"url", wsURL, logging.ErrorKey(), err)
+	}
+}
+
+// discover asks petasos at destinationURL for the websocket URL of the
+// backend to connect to
+func discover(ctx context.Context, client http.Client, destinationURL string, headerInfo *clientHeader, f *ClientFactory, logger log.Logger) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", destinationURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for name, values := range identityHeaders(headerInfo) {
+		req.Header[name] = values
+	}
+	if f.BeforeDial != nil {
+		f.BeforeDial(req)
+	}
+
+	// the backend petasos redirects to is dialed as a websocket, and may
+	// not be reachable at all, so the redirect isn't followed
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	discoveryStart := time.Now()
+	resp, err := client.Do(req)
+	req.Close = true
+
+	discoveryLatency := time.Since(discoveryStart)
+	f.metrics().ObserveDiscoveryLatency(discoveryLatency)
+	logging.Info(logger).Log(logging.MessageKey(), "Discovery done", "destinationURL", destinationURL,
+		"discoveryLatency", discoveryLatency, logging.ErrorKey(), err)
 
 	if err != nil {
-		return nil, "", err
+		return "", err
+	}
+
+	// the body is read once, right away, so that it is still there to explain
+	// the failure whichever way things go wrong later on
+	body := readBody(resp)
+
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		return "", createError(resp.StatusCode, body, errInvalidPetasosResponse)
+	}
+
+	location := resp.Header.Get("Location")
+	return strings.Replace(location, "http", "ws", 1) + "/api/v2/device", nil
+}
+
+// acquireDial waits for a slot in the DialSemaphore, if there is one, and
+// returns the function giving it back
+func (f *ClientFactory) acquireDial(ctx context.Context) (release func(), err error) {
+	if f.DialSemaphore == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case f.DialSemaphore <- struct{}{}:
+		return func() { <-f.DialSemaphore }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial opens the websocket to wsURL, timing the dial and handshake
+func dial(ctx context.Context, dialer websocket.Dialer, wsURL string, headers http.Header, f *ClientFactory, logger log.Logger) (*websocket.Conn, *http.Response, error) {
+	if f.BeforeHandshake != nil {
+		// each dial starts over from the device headers
+		headers = headers.Clone()
+		f.BeforeHandshake(wsURL, headers)
+	}
+
+	dialStart := time.Now()
+	connection, resp, err := dialer.DialContext(ctx, wsURL, headers)
+
+	dialLatency := time.Since(dialStart)
+	f.metrics().ObserveDialLatency(dialLatency)
+	logging.Info(logger).Log(logging.MessageKey(), "Dial done", "url", wsURL, "dialLatency", dialLatency,
+		logging.ErrorKey(), err)
+
+	return connection, resp, err
+}
+
+// dialBackend opens the websocket to a known backend without asking petasos
+// where to go
+func dialBackend(ctx context.Context, wsURL string, headerInfo *clientHeader, f *ClientFactory, logger log.Logger) (*websocket.Conn, *http.Response, error) {
+	release, err := f.acquireDial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	_, dialer, err := f.transport()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	connection, resp, err := dial(ctx, dialer, wsURL, deviceHeaders(headerInfo), f, logger)
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	return connection, resp, err
+}
+
+// upgradeConnection performs the websocket handshake for wsURL over conn, an
+// already established connection, which is used as is even for wss urls
+func upgradeConnection(ctx context.Context, conn net.Conn, wsURL string, headerInfo *clientHeader, f *ClientFactory) (*websocket.Conn, *http.Response, error) {
+	_, dialer, err := f.transport()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	adopt := func(context.Context, string, string) (net.Conn, error) {
+		return conn, nil
+	}
+	dialer.NetDial = nil
+	dialer.NetDialContext = adopt
+	dialer.NetDialTLSContext = adopt
+
+	connection, resp, err := dialer.DialContext(ctx, wsURL, deviceHeaders(headerInfo))
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	return connection, resp, err
+}
+
+// identityHeaders are the headers identifying the device, sent both during
+// discovery and the websocket dial
+func identityHeaders(headerInfo *clientHeader) http.Header {
+	name := headerInfo.deviceNameHeader
+	if name == "" {
+		name = defaultDeviceNameHeader
 	}
 
-	// make a header and put some data in that (including MAC address)
-	// TODO: find special function for user agent
 	headers := make(http.Header)
-	headers.Add("X-Webpa-Device-Name", headerInfo.deviceName)
+	// set as is, gateways may expect a casing of their own
+	headers[name] = []string{headerInfo.deviceName}
+	headers.Set("X-Webpa-Boot-Time", bootTimeHeader(headerInfo))
+	return headers
+}
+
+// make a header and put some data in that (including MAC address)
+// TODO: find special function for user agent
+func deviceHeaders(headerInfo *clientHeader) http.Header {
+	headers := identityHeaders(headerInfo)
 	headers.Add("X-Webpa-Firmware-Name", headerInfo.firmwareName)
 	headers.Add("X-Webpa-Model-Name", headerInfo.modelName)
 	headers.Add("X-Webpa-Manufacturer", headerInfo.manufacturer)
+	if len(headerInfo.services) > 0 {
+		headers.Add("X-Webpa-Services", strings.Join(headerInfo.services, ","))
+	}
+	for name, values := range headerInfo.extra {
+		headers[name] = values
+	}
+	return headers
+}
+
+func bootTimeHeader(headerInfo *clientHeader) string {
+	return strconv.FormatInt(headerInfo.bootTime.Unix(), 10)
+}
 
-	var client http.Client
-	var dialer websocket.Dialer
+// transport builds the http client used for discovery and the dialer used
+// for the websocket, both configured with the certificates, NetDial and DialTLSContext
+func (f *ClientFactory) transport() (client http.Client, dialer websocket.Dialer, err error) {
+	var transport *http.Transport
 
-	if crtFile != "" && keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if f.CRT != "" && f.Key != "" {
+		cert, err := tls.LoadX509KeyPair(f.CRT, f.Key)
 		if err != nil {
-			return nil, "", err
+			return client, dialer, err
 		}
 
 		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
 
-		transport := http.Transport{
+		transport = &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
 				KeepAlive: 300 * time.Second,
@@ -291,55 +2231,47 @@ func createConnection(headerInfo *clientHeader, httpURL string, crtFile string,
 		}
 
 		client = http.Client{
-			Transport: &transport,
+			Transport: transport,
 		}
 	}
 
-	req, err := http.NewRequest("GET", httpURL, nil)
-	req.Header.Set("X-Webpa-Device-Name", headerInfo.deviceName)
-	resp, err := client.Do(req)
-	req.Close = true
+	if len(f.PinnedCertFingerprints) > 0 {
+		if transport == nil {
+			transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{},
+			}
+			client.Transport = transport
+			dialer.TLSClientConfig = transport.TLSClientConfig
+		}
 
-	if err != nil {
-		return nil, "", err
+		// shared by the transport and the dialer
+		transport.TLSClientConfig.VerifyPeerCertificate = f.verifyPinned
 	}
 
-	defer resp.Body.Close()
+	dialer.WriteBufferPool = writeBufferPool
+	dialer.Subprotocols = f.Subprotocols
+	dialer.EnableCompression = f.CompressionMinSize > 0
 
-	if resp.Request.Response == nil {
-		return nil, "", errors.New("Petasos response is nil!")
+	if transport == nil && (f.NetDial != nil || f.DialTLSContext != nil) {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+		client.Transport = transport
 	}
-	
-	if resp.StatusCode == http.StatusTemporaryRedirect || resp.Request.Response.StatusCode == http.StatusTemporaryRedirect {
-		var location string
 
-		if location = resp.Header.Get("Location"); location != "" {
-			wsURL = strings.Replace(location, "http", "ws", 1) + "/api/v2/device"
-		} else {
-			location = resp.Request.Response.Header.Get("Location")
-			wsURL = strings.Replace(location, "http", "ws", 1) + "/api/v2/device"
-		}
-
-		//Get url to which we are redirected and reconfigure it
-		connection, resp, err = dialer.Dial(wsURL, headers)
-
-		if err != nil {
-			return nil, "", err
-		}
-
-		if resp == nil {
-			return nil, "", err
+	if f.NetDial != nil {
+		transport.DialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return f.NetDial(network, addr)
 		}
+		dialer.NetDial = f.NetDial
+	}
 
-		defer resp.Body.Close()
-	} else {
-		if resp != nil {
-			err = createError(resp, fmt.Errorf("Received invalid response from petasos!"))
-		}
-		return nil, "", err
+	if f.DialTLSContext != nil {
+		// both ignore their TLS config once they are given a TLS dial function
+		transport.DialTLSContext = f.DialTLSContext
+		dialer.NetDialTLSContext = f.DialTLSContext
 	}
 
-	return connection, wsURL, nil
+	return client, dialer, nil
 }
 
 type Message struct {
@@ -354,28 +2286,57 @@ func (msg Message) String() string {
 type Error struct {
 	Message  Message
 	SubError error
+
+	// Fields holds every field of a JSON object error body, the code and
+	// message included, for servers that say more than that
+	Fields map[string]interface{}
 }
 
-func createError(resp *http.Response, err error) *Error {
-	var msg Message
+// RequestID is the request-id the server put in its error body, if any, to be
+// quoted when asking it for support
+func (e *Error) RequestID() string {
+	requestID, _ := e.Fields["request-id"].(string)
+	return requestID
+}
+
+// errInvalidPetasosResponse is the error behind a discovery response that
+// isn't a redirect
+var errInvalidPetasosResponse = errors.New("Received invalid response from petasos!")
+
+// readBody reads and closes the body of resp
+func readBody(resp *http.Response) []byte {
 	defer resp.Body.Close()
-	data, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(data, &msg)
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body
+}
+
+// createError builds an Error out of the status code and body of a response
+func createError(statusCode int, body []byte, err error) *Error {
+	var msg Message
+	json.Unmarshal(body, &msg)
+
+	var fields map[string]interface{}
+	json.Unmarshal(body, &fields)
+
+	if msg.Code == 0 {
+		msg.Code = statusCode
+	}
 
 	if msg.Message == "" {
-		switch resp.StatusCode {
+		switch statusCode {
 		case StatusDeviceDisconnected:
 			msg.Message = "ErrorDeviceBusy"
 		case StatusDeviceTimeout:
 			msg.Message = "ErrorTransactionsClosed/ErrorTransactionsAlreadyClosed/ErrorDeviceClosed"
 		default:
-			msg.Message = http.StatusText(msg.Code)
+			msg.Message = http.StatusText(statusCode)
 		}
 	}
 
 	return &Error{
 		Message:  msg,
 		SubError: err,
+		Fields:   fields,
 	}
 }
 
@@ -2,13 +2,18 @@ package kratos
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -63,6 +68,9 @@ var (
 
 	testServer *httptest.Server
 
+	// redirects to testServer the way petasos does
+	testPetasos *httptest.Server
+
 	goodMsg []byte
 
 	ErrFoo = errors.New("this was supposed to happen")
@@ -85,16 +93,215 @@ func (m *mockClient) Hostname() string {
 	return arguments.String(0)
 }
 
+func (m *mockClient) Subprotocol() string {
+	arguments := m.Called()
+	return arguments.String(0)
+}
+
+func (m *mockClient) UnderlyingConn() (*websocket.Conn, bool) {
+	arguments := m.Called()
+	conn, _ := arguments.Get(0).(*websocket.Conn)
+	return conn, arguments.Bool(1)
+}
+
+func (m *mockClient) ConnectionID() string {
+	arguments := m.Called()
+	return arguments.String(0)
+}
+
+func (m *mockClient) IsSecure() bool {
+	arguments := m.Called()
+	return arguments.Bool(0)
+}
+
+func (m *mockClient) DeviceScheme() string {
+	arguments := m.Called()
+	return arguments.String(0)
+}
+
+func (m *mockClient) NewMessage() *MessageBuilder {
+	arguments := m.Called()
+	return arguments.Get(0).(*MessageBuilder)
+}
+
 func (m *mockClient) Send(message interface{}) error {
 	arguments := m.Called(message)
 	return arguments.Error(0)
 }
 
+func (m *mockClient) SendWithDeadline(d time.Duration, message interface{}) error {
+	arguments := m.Called(d, message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) RegisterPayloadCodec(contentType string, decode func([]byte, interface{}) error) {
+	m.Called(contentType, decode)
+}
+
+func (m *mockClient) LastCloseReason() (int, string) {
+	arguments := m.Called()
+	return arguments.Int(0), arguments.String(1)
+}
+
+func (m *mockClient) GoroutineCount() int {
+	arguments := m.Called()
+	return arguments.Int(0)
+}
+
+func (m *mockClient) CloseWithReport(ctx context.Context) (CloseReport, error) {
+	arguments := m.Called(ctx)
+	return arguments.Get(0).(CloseReport), arguments.Error(1)
+}
+
+func (m *mockClient) PauseDispatch() {
+	m.Called()
+}
+
+func (m *mockClient) ResumeDispatch() {
+	m.Called()
+}
+
+func (m *mockClient) ForPartner(partnerID string) Client {
+	arguments := m.Called(partnerID)
+	return arguments.Get(0).(Client)
+}
+
+func (m *mockClient) RegisterHandler(h HandlerRegistry) error {
+	arguments := m.Called(h)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) DeregisterHandler(handlerKey string) bool {
+	arguments := m.Called(handlerKey)
+	return arguments.Bool(0)
+}
+
+func (m *mockClient) SendFile(destination, path, contentType string) error {
+	arguments := m.Called(destination, path, contentType)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendSticky(destination string, message interface{}) error {
+	arguments := m.Called(destination, message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) TrySend(message interface{}) error {
+	arguments := m.Called(message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendMany(ctx context.Context, msgs []interface{}) (int, error) {
+	arguments := m.Called(ctx, msgs)
+	return arguments.Int(0), arguments.Error(1)
+}
+
+func (m *mockClient) SendStream(destination string, r io.Reader, chunkSize int) error {
+	arguments := m.Called(destination, r, chunkSize)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendPriority(p Priority, message interface{}) error {
+	arguments := m.Called(p, message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendFrame(frameType int, message interface{}) error {
+	arguments := m.Called(frameType, message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendEvent(destination string, payload []byte) error {
+	arguments := m.Called(destination, payload)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendWithResponse(ctx context.Context, message wrp.Message, options ...RequestOption) (wrp.Message, error) {
+	arguments := m.Called(ctx, message, options)
+	return arguments.Get(0).(wrp.Message), arguments.Error(1)
+}
+
+func (m *mockClient) SendConfirmed(ctx context.Context, message wrp.Message, options ...RequestOption) error {
+	arguments := m.Called(ctx, message, options)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) OnAck(transactionUUID string, fn func()) {
+	m.Called(transactionUUID, fn)
+}
+
 func (m *mockClient) Close() error {
 	arguments := m.Called()
 	return arguments.Error(0)
 }
 
+func (m *mockClient) CloseCtx(ctx context.Context) error {
+	arguments := m.Called(ctx)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) ExportConnection() (*ExportedConnection, error) {
+	arguments := m.Called()
+	exported, _ := arguments.Get(0).(*ExportedConnection)
+	return exported, arguments.Error(1)
+}
+
+func (m *mockClient) CloseDrain(ctx context.Context) error {
+	arguments := m.Called(ctx)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) SendAndClose(ctx context.Context, message interface{}) error {
+	arguments := m.Called(ctx, message)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) QueueDepth() int {
+	arguments := m.Called()
+	return arguments.Int(0)
+}
+
+func (m *mockClient) SetPingPeriod(d time.Duration) error {
+	arguments := m.Called(d)
+	return arguments.Error(0)
+}
+
+func (m *mockClient) ReconnectHistory() []ReconnectEvent {
+	arguments := m.Called()
+	return arguments.Get(0).([]ReconnectEvent)
+}
+
+func (m *mockClient) RecentMessages() []wrp.Message {
+	arguments := m.Called()
+	return arguments.Get(0).([]wrp.Message)
+}
+
+func (m *mockClient) AnalyzeHandlers() []HandlerConflict {
+	arguments := m.Called()
+	return arguments.Get(0).([]HandlerConflict)
+}
+
+func (m *mockClient) WouldMatch(destination string) []string {
+	arguments := m.Called(destination)
+	keys, _ := arguments.Get(0).([]string)
+	return keys
+}
+
+func (m *mockClient) Stats() Stats {
+	arguments := m.Called()
+	return arguments.Get(0).(Stats)
+}
+
+func (m *mockClient) Healthy() (bool, string) {
+	arguments := m.Called()
+	return arguments.Bool(0), arguments.String(1)
+}
+
+func (m *mockClient) InflightRequests() int {
+	arguments := m.Called()
+	return arguments.Int(0)
+}
+
 type mockConnection struct {
 	mock.Mock
 }
@@ -104,9 +311,19 @@ func (m *mockConnection) WriteMessage(messageType int, data []byte) error {
 	return arguments.Error(0)
 }
 
-func (m *mockConnection) ReadMessage() (messageType int, p []byte, err error) {
+// NextReader accepts a []byte or a func() io.Reader so every call can get a
+// fresh reader over the same message
+func (m *mockConnection) NextReader() (messageType int, r io.Reader, err error) {
 	arguments := m.Called()
-	return arguments.Int(0), arguments.Get(1).([]byte), arguments.Error(2)
+	switch message := arguments.Get(1).(type) {
+	case []byte:
+		r = bytes.NewReader(message)
+	case func() io.Reader:
+		r = message()
+	default:
+		r = message.(io.Reader)
+	}
+	return arguments.Int(0), r, arguments.Error(2)
 }
 
 func (m *mockConnection) Close() error {
@@ -124,8 +341,8 @@ type myReadHandler struct {
 
 func (m *myReadHandler) HandleMessage(msg interface{}) {
 	if !m.handlerCalled {
-		mainWG.Done()
 		m.handlerCalled = true
+		mainWG.Done()
 	}
 }
 
@@ -135,7 +352,12 @@ func TestMain(m *testing.M) {
 	}))
 	defer testServer.Close()
 
-	testClientFactory.DestinationURL = testServer.URL
+	testPetasos = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, testServer.URL, http.StatusTemporaryRedirect)
+	}))
+	defer testPetasos.Close()
+
+	testClientFactory.DestinationURL = testPetasos.URL
 
 	wrpMsg := wrp.SimpleRequestResponse{
 		Source:          "mac:ffffff112233/emu",
@@ -174,154 +396,1385 @@ func TestErrorCreation(t *testing.T) {
 	testClientFactory.DestinationURL = brokenServer.URL
 	_, err := testClientFactory.New()
 
-	testClientFactory.DestinationURL = testServer.URL
+	testClientFactory.DestinationURL = testPetasos.URL
 
 	assert.NotNil(err)
-	expected := fmt.Sprintf("message: %s with error: %s", Message{code, msg}, websocket.ErrBadHandshake)
+	expected := fmt.Sprintf("message: %s with error: %s", Message{code, msg}, errInvalidPetasosResponse)
 	assert.Equal(expected, err.Error())
 }
 
-func TestNew(t *testing.T) {
+// test that the subprotocol the server picked is captured after the dial
+// test that the fields of a richer error body are kept
+func TestCreateErrorFields(t *testing.T) {
+	assert := assert.New(t)
+
+	err := createError(http.StatusForbidden,
+		[]byte(`{"code": 403, "message": "denied", "request-id": "5c1e", "details": {"reason": "revoked"}}`),
+		errInvalidPetasosResponse)
+
+	assert.Equal(Message{http.StatusForbidden, "denied"}, err.Message)
+	assert.Equal("5c1e", err.RequestID())
+	assert.Equal(map[string]interface{}{"reason": "revoked"}, err.Fields["details"])
+
+	// a body that isn't a JSON object has no fields
+	err = createError(http.StatusBadGateway, []byte("bad gateway"), errInvalidPetasosResponse)
+	assert.Nil(err.Fields)
+	assert.Empty(err.RequestID())
+}
+
+func TestSubprotocol(t *testing.T) {
 	assert := assert.New(t)
-	testClient, err := testClientFactory.New()
 
-	assert.Equal("127.0.0.1", testClient.Hostname())
+	subprotocolUpgrader := &websocket.Upgrader{Subprotocols: []string{"wrp.v2", "wrp.v1"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subprotocolUpgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
+
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
+
+	testClient, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+		Subprotocols:   []string{"wrp.v1", "wrp.v0"},
+	}).New()
+
 	assert.Nil(err)
+	if testClient != nil {
+		assert.Equal("wrp.v1", testClient.Subprotocol())
+		testClient.Close()
+	}
 }
 
-func TestNewBrokenMAC(t *testing.T) {
+// test that every connection gets an id of its own
+func TestConnectionID(t *testing.T) {
 	assert := assert.New(t)
-	goodMac := testClientFactory.DeviceName
-	testClientFactory.DeviceName = "broken:mac"
-	_, err := testClientFactory.New()
 
-	testClientFactory.DeviceName = goodMac
-	assert.NotNil(err)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
+
+	testClient, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: "http://unused.example.com",
+		ClientLogger:   logging.New(nil),
+	}).newClient()
+	assert.Nil(err)
+	assert.Empty(testClient.ConnectionID())
+
+	wsURL := strings.Replace(backend.URL, "http", "ws", 1)
+	assert.Nil(testClient.connectTo(context.Background(), wsURL, nil))
+	first := testClient.ConnectionID()
+	assert.Len(first, 8)
+
+	testClient.pingHandler.stopPingHandler()
+	assert.Nil(testClient.connectTo(context.Background(), wsURL, nil))
+	assert.NotEqual(first, testClient.ConnectionID())
+	testClient.Close()
 }
 
-func TestNewBrokenURL(t *testing.T) {
+func TestUnderlyingConn(t *testing.T) {
 	assert := assert.New(t)
-	goodURL := testClientFactory.DestinationURL
-	testClientFactory.DestinationURL = "broken.url"
-	_, err := testClientFactory.New()
 
-	testClientFactory.DestinationURL = goodURL
-	assert.NotNil(err)
+	testClient := &client{}
+	conn, ok := testClient.UnderlyingConn()
+	assert.Nil(conn)
+	assert.False(ok)
+
+	// a connection that isn't gorilla's can't be handed out
+	testClient.connection = &mockConnection{}
+	conn, ok = testClient.UnderlyingConn()
+	assert.Nil(conn)
+	assert.False(ok)
+
+	testClient.connection = &websocket.Conn{}
+	conn, ok = testClient.UnderlyingConn()
+	assert.NotNil(conn)
+	assert.True(ok)
 }
 
-func TestBadHandshake(t *testing.T) {
+// test that the hooks can add headers to discovery and to the handshake
+func TestBeforeDialAndHandshake(t *testing.T) {
 	assert := assert.New(t)
 
-	brokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// do nothing so the websocket receives a bad handshake
+	handshakeSignature := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the discovery redirect is followed here too, before the dial
+		if r.Header.Get("Upgrade") == "websocket" {
+			handshakeSignature <- r.Header.Get("X-Signature")
+		}
+		upgrader.Upgrade(w, r, nil)
 	}))
-	defer brokenServer.Close()
+	defer backend.Close()
 
-	testClientFactory.DestinationURL = brokenServer.URL
-	_, err := testClientFactory.New()
+	discoverySignature := make(chan string, 1)
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		discoverySignature <- r.Header.Get("X-Signature")
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
+
+	testClient, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+		BeforeDial: func(req *http.Request) {
+			req.Header.Set("X-Signature", "signed:"+req.URL.Path)
+		},
+		BeforeHandshake: func(wsURL string, header http.Header) {
+			header.Set("X-Signature", "signed:"+header.Get("X-Webpa-Device-Name"))
+		},
+	}).New()
 
-	testClientFactory.DestinationURL = testServer.URL
+	assert.Nil(err)
+	assert.Equal("signed:", <-discoverySignature)
+	assert.Equal("signed:mac:ffffff112233", <-handshakeSignature)
 
-	assert.NotNil(err)
+	if testClient != nil {
+		testClient.Close()
+	}
 }
 
-func TestCheckPingTimeout(t *testing.T) {
+// test that OnConnect runs once connected and that its failure fails New
+func TestOnConnect(t *testing.T) {
 	assert := assert.New(t)
-	timesCalled := 0
 
-	fakeClient := &mockClient{}
-	fakeClient.On("Close").Return(nil).Once()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
 
-	testPingMissHandler := pingHandler{
-		handlePingMiss: func() error {
-			timesCalled++
-			return nil
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
+
+	registrationErr := errors.New("registration refused")
+	var connected []string
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+		OnConnect: func(c Client) error {
+			connected = append(connected, c.Hostname())
+			return registrationErr
 		},
-		stop:   make(chan bool),
-		Logger: logging.New(nil),
 	}
 
-	pingTimer := time.NewTimer(time.Duration(1) * time.Second)
-	pinged := make(chan string)
+	_, err := factory.New()
+	assert.True(errors.Is(err, registrationErr))
 
-	testPingMissHandler.checkPing(pingTimer, pinged, fakeClient)
+	factory.OnConnect = func(c Client) error {
+		connected = append(connected, c.Hostname())
+		return nil
+	}
 
-	assert.Equal(1, timesCalled)
-	fakeClient.AssertExpectations(t)
+	testClient, err := factory.New()
+	assert.Nil(err)
+	if assert.Len(connected, 2) {
+		assert.NotEmpty(connected[1])
+	}
+
+	if testClient != nil {
+		testClient.Close()
+	}
 }
 
-// test the happy-path of sending a message through a websocket
-func TestSend(t *testing.T) {
+// test that clients sharing a DialSemaphore don't connect at the same time
+// test that the challenge of the handshake response is answered first thing
+func TestHandshakeChallenge(t *testing.T) {
 	assert := assert.New(t)
-	fakeConn := &mockConnection{}
-	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
 
-	myMessage := wrp.SimpleRequestResponse{
-		Source:      "mac:ffffff112233/emu",
-		Destination: "event:device-status/bla/bla",
-		Payload:     []byte("the payload has reached the checkpoint"),
-	}
+	answers := make(chan []byte, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Challenge": {"42"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var answer wrp.Message
+		if _, data, err := conn.ReadMessage(); err == nil && wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&answer) == nil {
+			answers <- answer.Payload
+		}
+	}))
+	defer backend.Close()
 
-	testClient := &client{
-		connection: fakeConn,
-		Logger:     logging.New(nil),
+	challengeErr := errors.New("no challenge")
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: "http://unused.example.com",
+		ClientLogger:   logging.New(nil),
+		HandshakeChallenge: func(resp *http.Response) (interface{}, error) {
+			challenge := resp.Header.Get("X-Challenge")
+			if challenge == "" {
+				return nil, challengeErr
+			}
+			return wrp.SimpleEvent{Destination: "event:challenge", Payload: []byte(challenge)}, nil
+		},
 	}
 
-	err := testClient.Send(myMessage)
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+
+	wsURL := strings.Replace(backend.URL, "http", "ws", 1)
+	assert.Nil(testClient.connectTo(context.Background(), wsURL, nil))
+	assert.Equal([]byte("42"), <-answers)
+	testClient.Close()
+
+	// the connection is dropped when the challenge can't be answered
+	noChallenge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer noChallenge.Close()
 
+	testClient, err = factory.newClient()
 	assert.Nil(err)
-	fakeConn.AssertExpectations(t)
+	err = testClient.connectTo(context.Background(), strings.Replace(noChallenge.URL, "http", "ws", 1), nil)
+	assert.True(errors.Is(err, challengeErr))
 }
 
-// test what happens when a websocket fails to write a message
-func TestSendBrokenWriteMessage(t *testing.T) {
+func TestDialSemaphore(t *testing.T) {
 	assert := assert.New(t)
 
-	fakeConn := &mockConnection{}
-	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(ErrFoo).Once()
+	var connecting, maxConnecting int32
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&connecting, 1)
+		defer atomic.AddInt32(&connecting, -1)
 
-	testClient := &client{
-		connection: fakeConn,
-		Logger:     logging.New(nil),
+		for {
+			highest := atomic.LoadInt32(&maxConnecting)
+			if n <= highest || atomic.CompareAndSwapInt32(&maxConnecting, highest, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer petasos.Close()
+
+	semaphore := make(chan struct{}, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			(&ClientFactory{
+				DeviceName:     "mac:ffffff112233",
+				DestinationURL: petasos.URL,
+				ClientLogger:   logging.New(nil),
+				DialSemaphore:  semaphore,
+			}).New()
+		}()
 	}
 
-	err := testClient.Send(nil)
+	wg.Wait()
+	assert.True(atomic.LoadInt32(&maxConnecting) <= 2)
+	assert.Len(semaphore, 0)
 
-	assert.NotNil(err)
-	fakeConn.AssertExpectations(t)
+	// a full semaphore gives way to the context
+	semaphore <- struct{}{}
+	semaphore <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+		DialSemaphore:  semaphore,
+	}).NewCtx(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
 }
 
-// test the happy path of closing a websocket once we're finished using it
-func TestClose(t *testing.T) {
+// test that petasos is asked again when the backend it picked can't be reached
+func TestRediscoverOnDialFailure(t *testing.T) {
 	assert := assert.New(t)
 
-	fakeConn := &mockConnection{}
-	fakeConn.On("Close").Return(nil).Once()
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	gone.Close()
 
-	testClient := &client{
-		connection: fakeConn,
-		Logger:     logging.New(nil),
-	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
+
+	// the first backend handed out is gone, then the live one is, unless
+	// onlyGone is set
+	var discoveries, onlyGone int32
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := backend.URL
+		if atomic.AddInt32(&discoveries, 1) == 1 || atomic.LoadInt32(&onlyGone) == 1 {
+			location = gone.URL
+		}
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
 
-	err := testClient.Close()
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+	}
 
+	testClient, err := factory.New()
 	assert.Nil(err)
-	fakeConn.AssertExpectations(t)
+	assert.Equal(int32(2), atomic.LoadInt32(&discoveries))
+	if testClient != nil {
+		testClient.Close()
+	}
+
+	// a backend that can never be reached ends the attempts
+	atomic.StoreInt32(&onlyGone, 1)
+	atomic.StoreInt32(&discoveries, 0)
+
+	_, err = factory.New()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "after 2 discovery attempt(s)")
+	}
+	assert.Equal(int32(maxDiscoveryAttempts), atomic.LoadInt32(&discoveries))
 }
 
-// test what happens when we get an error closing the websocket
-func TestCloseBroken(t *testing.T) {
+// test that the body of a refused handshake makes it into the error
+func TestDialErrorCreation(t *testing.T) {
 	assert := assert.New(t)
-	fakeConn := &mockConnection{}
 
-	fakeConn.On("Close").Return(ErrFoo).Once()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"code": 403, "message": "device is not allowed to connect"}`)
+	}))
+	defer backend.Close()
 
-	testClient := &client{
-		connection: fakeConn,
-		Logger:     logging.New(nil),
-	}
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
 
-	err := testClient.Close()
+	_, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+	}).New()
+
+	assert.NotNil(err)
+	expected := fmt.Sprintf("message: %s with error: %s", Message{http.StatusForbidden, "device is not allowed to connect"}, websocket.ErrBadHandshake)
+	assert.Equal(expected, err.Error())
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	testClient, err := testClientFactory.New()
+
+	if assert.Nil(err) {
+		assert.Equal(strings.Replace(testServer.URL, "http", "ws", 1)+"/api/v2/device", testClient.Hostname())
+		testClient.Close()
+	}
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(closeGracePeriod, (&ClientFactory{}).closeGracePeriod())
+	assert.Equal(5*time.Second, (&ClientFactory{CloseGracePeriod: 5 * time.Second}).closeGracePeriod())
+}
+
+func TestTransportDialTLSContext(t *testing.T) {
+	assert := assert.New(t)
+
+	type key struct{}
+	dialTLS := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		assert.Equal("request", ctx.Value(key{}))
+		return nil, ErrFoo
+	}
+
+	httpClient, dialer, err := (&ClientFactory{DialTLSContext: dialTLS}).transport()
+
+	assert.Nil(err)
+	assert.NotNil(dialer.NetDialTLSContext)
+	if assert.IsType(&http.Transport{}, httpClient.Transport) {
+		// the context of the request reaches the dial
+		ctx := context.WithValue(context.Background(), key{}, "request")
+		_, err = httpClient.Transport.(*http.Transport).DialTLSContext(ctx, "tcp", "localhost:443")
+		assert.Equal(ErrFoo, err)
+	}
+}
+
+func TestDeviceHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	headers := deviceHeaders(&clientHeader{
+		deviceName:   "mac:ffffff112233",
+		firmwareName: "TG1682_2.1p7s1_PROD_sey",
+		modelName:    "TG1682G",
+		manufacturer: "ARRIS Group, Inc.",
+		bootTime:     time.Unix(1500000000, 0),
+	})
+
+	assert.Equal("mac:ffffff112233", headers.Get("X-Webpa-Device-Name"))
+	assert.Equal("1500000000", headers.Get("X-Webpa-Boot-Time"))
+
+	testClient, err := (&ClientFactory{DeviceName: "mac:ffffff112233", ClientLogger: logging.New(nil)}).newClient()
+	assert.Nil(err)
+	assert.Equal(processStart, testClient.headerInfo.bootTime)
+
+	// the device name header is set with the casing it is given
+	headers = identityHeaders(&clientHeader{deviceName: "mac:ffffff112233", deviceNameHeader: "x-device-id"})
+	assert.Equal([]string{"mac:ffffff112233"}, headers["x-device-id"])
+	assert.Empty(headers.Get("X-Webpa-Device-Name"))
+	assert.NotEmpty(headers.Get("X-Webpa-Boot-Time"))
+}
+
+func TestNewCtxCanceled(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testClient, err := testClientFactory.NewCtx(ctx)
+
+	assert.Nil(testClient)
+	assert.NotNil(err)
+}
+
+func TestNewIsSecure(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient, err := testClientFactory.New()
+
+	assert.Nil(err)
+	if assert.NotNil(testClient) {
+		assert.False(testClient.IsSecure())
+		testClient.Close()
+	}
+}
+
+func TestNewWithConn(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := testServer.Listener.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(err)
+
+	testClient, err := testClientFactory.NewWithConn(conn, "ws://"+addr+"/api/v2/device")
+
+	assert.Nil(err)
+	if assert.NotNil(testClient) {
+		assert.Equal("ws://"+addr+"/api/v2/device", testClient.Hostname())
+	}
+}
+
+func TestNewDuplicateHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	factory := &ClientFactory{
+		DeviceName: "mac:ffffff112233",
+		Handlers: []HandlerRegistry{
+			{HandlerKey: "/foo", Handler: &myReadHandler{handlerCalled: true}},
+			{HandlerKey: "/bar", Handler: &myReadHandler{handlerCalled: true}},
+			{HandlerKey: "/foo", Handler: &myReadHandler{handlerCalled: true}},
+		},
+		ClientLogger: logging.New(nil),
+	}
+
+	_, err := factory.newClient()
+	assert.Nil(err)
+
+	factory.RejectDuplicateHandlers = true
+	_, err = factory.newClient()
+	assert.True(errors.Is(err, ErrDuplicateHandlerKey))
+}
+
+// test that handlers are ordered by priority, then by registration
+func TestNewHandlerPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	factory := &ClientFactory{
+		DeviceName: "mac:ffffff112233",
+		Handlers: []HandlerRegistry{
+			{HandlerKey: "/first", Handler: &myReadHandler{}},
+			{HandlerKey: "/urgent", Handler: &myReadHandler{}, Priority: 10},
+			{HandlerKey: "/second", Handler: &myReadHandler{}},
+			{HandlerKey: "/late", Handler: &myReadHandler{}, Priority: -1},
+			{HandlerKey: "/also-urgent", Handler: &myReadHandler{}, Priority: 10},
+		},
+		ClientLogger: logging.New(nil),
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+
+	var keys []string
+	for _, h := range testClient.handlers {
+		keys = append(keys, h.HandlerKey)
+	}
+	assert.Equal([]string{"/urgent", "/also-urgent", "/first", "/second", "/late"}, keys)
+
+	// the factory's own handlers are left as they were
+	assert.Equal("/first", factory.Handlers[0].HandlerKey)
+}
+
+func TestNewAllowedSchemes(t *testing.T) {
+	assert := assert.New(t)
+
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		AllowedSchemes: []string{"uuid", "MAC"},
+		ClientLogger:   logging.New(nil),
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+	assert.Equal("mac", testClient.DeviceScheme())
+
+	factory.AllowedSchemes = []string{"uuid", "serial"}
+	_, err = factory.newClient()
+	assert.True(errors.Is(err, ErrDeviceSchemeNotAllowed))
+}
+
+func TestNewBrokenMAC(t *testing.T) {
+	assert := assert.New(t)
+	goodMac := testClientFactory.DeviceName
+	testClientFactory.DeviceName = "broken:mac"
+	_, err := testClientFactory.New()
+
+	testClientFactory.DeviceName = goodMac
+	assert.NotNil(err)
+}
+
+func TestNewBrokenURL(t *testing.T) {
+	assert := assert.New(t)
+	goodURL := testClientFactory.DestinationURL
+	testClientFactory.DestinationURL = "broken.url"
+	_, err := testClientFactory.New()
+
+	testClientFactory.DestinationURL = goodURL
+	assert.NotNil(err)
+}
+
+func TestBadHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	brokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// do nothing so the websocket receives a bad handshake
+	}))
+	defer brokenServer.Close()
+
+	testClientFactory.DestinationURL = brokenServer.URL
+	_, err := testClientFactory.New()
+
+	testClientFactory.DestinationURL = testPetasos.URL
+
+	assert.NotNil(err)
+}
+
+// test that a ping that can't be written is reported as missed
+func TestCheckPingTimeout(t *testing.T) {
+	assert := assert.New(t)
+	timesCalled := 0
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1), nil)
+	if !assert.Nil(err) {
+		return
+	}
+	conn.UnderlyingConn().Close()
+
+	testPingMissHandler := pingHandler{
+		conn: conn,
+		handlePingMiss: func() error {
+			timesCalled++
+			return nil
+		},
+		stop:   make(chan bool),
+		Logger: logging.New(nil),
+	}
+
+	assert.NotNil(testPingMissHandler.sendPing(&client{}, nil))
+	assert.Equal(1, timesCalled)
+}
+
+// test that the ping handler gives up on a connection a ping can't be written
+// to, reconnecting for it
+func TestCheckPingReconnects(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1), nil)
+	if !assert.Nil(err) {
+		return
+	}
+	conn.UnderlyingConn().Close()
+
+	reasons := make(chan string, 10)
+	testClient := &client{
+		connection: conn,
+		pingPeriod: int64(10 * time.Millisecond),
+		Logger:     logging.New(nil),
+		shutdown:   make(chan struct{}),
+		headerInfo: &clientHeader{deviceName: "mac:ffffff112233"},
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return nil, errors.New("unreachable")
+			},
+			OnBackoff: func(attempt int, delay time.Duration, why string) {
+				if attempt == 1 {
+					reasons <- why
+				}
+			},
+		},
+	}
+
+	testPingHandler := &pingHandler{
+		conn:   conn,
+		stop:   make(chan bool),
+		done:   make(chan struct{}),
+		Logger: logging.New(nil),
+	}
+	testClient.pingHandler = testPingHandler
+
+	go testPingHandler.checkPing(testClient)
+	select {
+	case <-testPingHandler.done:
+	case <-time.After(3 * time.Second):
+		assert.Fail("the ping handler kept going after the ping failed")
+	}
+
+	select {
+	case why := <-reasons:
+		assert.Equal(string(ReconnectPingMiss), why)
+	case <-time.After(3 * time.Second):
+		assert.Fail("no reconnect")
+	}
+	assert.Nil(testClient.Close())
+}
+
+func TestReadDeadline(t *testing.T) {
+	tests := []struct {
+		readDeadline time.Duration
+		expected     time.Duration
+	}{
+		{0, pongWait},
+		{time.Minute, time.Minute},
+		{-1, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.readDeadline.String(), func(t *testing.T) {
+			assert.New(t).Equal(tc.expected, (&ClientFactory{ReadDeadline: tc.readDeadline}).readDeadline())
+		})
+	}
+}
+
+func TestFactoryPingPeriod(t *testing.T) {
+	tests := []struct {
+		description string
+		factory     ClientFactory
+		expected    time.Duration
+	}{
+		{"defaults", ClientFactory{}, pingPeriod},
+		{"read deadline", ClientFactory{ReadDeadline: time.Minute}, 54 * time.Second},
+		{"no read deadline", ClientFactory{ReadDeadline: -1}, pingPeriod},
+		{"set", ClientFactory{ReadDeadline: time.Minute, PingPeriod: 30 * time.Second}, 30 * time.Second},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			assert.Equal(tc.expected, tc.factory.pingPeriod())
+			assert.Equal(tc.expected, (&client{factory: tc.factory}).currentPingPeriod())
+		})
+	}
+}
+
+func TestSetPingPeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{}
+	assert.Equal(pingPeriod, testClient.currentPingPeriod())
+
+	assert.Nil(testClient.SetPingPeriod(30 * time.Second))
+	assert.Equal(30*time.Second, testClient.currentPingPeriod())
+
+	assert.True(errors.Is(testClient.SetPingPeriod(0), ErrInvalidPingPeriod))
+	assert.True(errors.Is(testClient.SetPingPeriod(pongWait), ErrInvalidPingPeriod))
+	assert.Equal(30*time.Second, testClient.currentPingPeriod())
+}
+
+// test that the ping period is checked against the timing the client was
+// made with rather than the defaults
+func TestSetPingPeriodFactoryTiming(t *testing.T) {
+	tests := []struct {
+		description string
+		factory     ClientFactory
+		period      time.Duration
+		valid       bool
+	}{
+		{"longer read deadline", ClientFactory{ReadDeadline: 5 * time.Minute}, 2 * time.Minute, true},
+		{"shorter read deadline", ClientFactory{ReadDeadline: 20 * time.Second}, 30 * time.Second, false},
+		{"no read deadline", ClientFactory{ReadDeadline: -1}, 10 * time.Minute, true},
+		{"longer pong age", ClientFactory{HealthThresholds: HealthThresholds{MaxPongAge: 40 * time.Second}}, 30 * time.Second, true},
+		{"shorter pong age", ClientFactory{HealthThresholds: HealthThresholds{MaxPongAge: 20 * time.Second}}, 30 * time.Second, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			testClient := &client{factory: tc.factory}
+			err := testClient.SetPingPeriod(tc.period)
+			if tc.valid {
+				assert.Nil(err)
+				assert.Equal(tc.period, testClient.currentPingPeriod())
+			} else {
+				assert.True(errors.Is(err, ErrInvalidPingPeriod))
+				assert.Equal(tc.factory.pingPeriod(), testClient.currentPingPeriod())
+			}
+		})
+	}
+}
+
+// test that the hooks see the pings going out and the pongs coming back
+func TestPingPongHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// reading is what answers the pings
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	pingsSent := make(chan struct{}, 10)
+	pongs := make(chan string, 10)
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: "http://unused.example.com",
+		ClientLogger:   logging.New(nil),
+		OnPingSent: func() {
+			pingsSent <- struct{}{}
+		},
+		OnPongReceived: func(appData string) {
+			pongs <- appData
+		},
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+	testClient.pingPeriod = int64(10 * time.Millisecond)
+
+	assert.Nil(testClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil))
+	defer testClient.Close()
+
+	select {
+	case <-pingsSent:
+	case <-time.After(time.Second):
+		assert.Fail("no ping was sent")
+	}
+
+	select {
+	case appData := <-pongs:
+		assert.Equal("1", appData)
+	case <-time.After(time.Second):
+		assert.Fail("no pong was received")
+	}
+}
+
+func TestPongReceived(t *testing.T) {
+	assert := assert.New(t)
+
+	var rtts []time.Duration
+	testPingHandler := &pingHandler{
+		onPong: func(rtt time.Duration) {
+			rtts = append(rtts, rtt)
+		},
+		pingID:     7,
+		pingSentAt: time.Now().Add(-time.Second),
+	}
+
+	testPingHandler.pongReceived("6")
+	assert.Empty(rtts)
+
+	testPingHandler.pongReceived("7")
+	if assert.Len(rtts, 1) {
+		assert.True(rtts[0] >= time.Second)
+	}
+}
+
+// test that Hostname can be read while a reconnect replaces it
+func TestHostnameConcurrentReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{}
+	assert.Equal("", testClient.Hostname())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			testClient.hostname.Store(fmt.Sprintf("ws://talaria-%d:8080/api/v2/device", i%2))
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		hostname := testClient.Hostname()
+		assert.True(hostname == "" || hostname == "ws://talaria-0:8080/api/v2/device" || hostname == "ws://talaria-1:8080/api/v2/device")
+	}
+	<-done
+}
+
+// test the happy-path of sending a message through a websocket
+func TestSend(t *testing.T) {
+	assert := assert.New(t)
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	myMessage := wrp.SimpleRequestResponse{
+		Source:      "mac:ffffff112233/emu",
+		Destination: "event:device-status/bla/bla",
+		Payload:     []byte("the payload has reached the checkpoint"),
+	}
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.Send(myMessage)
+
+	assert.Nil(err)
+	fakeConn.AssertExpectations(t)
+}
+
+type deadlineConnection struct {
+	mockConnection
+	deadlines []time.Time
+}
+
+func (d *deadlineConnection) SetWriteDeadline(t time.Time) error {
+	d.deadlines = append(d.deadlines, t)
+	return nil
+}
+
+// test that a deadline given to one send doesn't carry over to the next
+func TestSendWithDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &deadlineConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Twice()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	start := time.Now()
+	assert.Nil(testClient.SendWithDeadline(time.Minute, wrp.SimpleEvent{Destination: "event:test"}))
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+
+	if assert.Len(fakeConn.deadlines, 2) {
+		assert.WithinDuration(start.Add(time.Minute), fakeConn.deadlines[0], time.Second)
+		assert.WithinDuration(start.Add(writeWait), fakeConn.deadlines[1], time.Second)
+	}
+	fakeConn.AssertExpectations(t)
+}
+
+// test that the write deadline of a message can scale with its size
+func TestWriteDeadlineFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &deadlineConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Times(3)
+
+	var sizes []int
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+		factory: ClientFactory{
+			WriteDeadlineFunc: func(size int) time.Duration {
+				sizes = append(sizes, size)
+				return time.Second + time.Duration(size)*time.Millisecond
+			},
+		},
+	}
+
+	start := time.Now()
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test", Payload: make([]byte, 4096)}))
+	assert.Nil(testClient.SendWithDeadline(time.Minute, wrp.SimpleEvent{Destination: "event:test"}))
+
+	testClient.factory.WriteDeadlineFunc = func(int) time.Duration { return 0 }
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+
+	if assert.Len(sizes, 1) && assert.Len(fakeConn.deadlines, 3) {
+		assert.True(sizes[0] > 4096)
+		assert.WithinDuration(start.Add(time.Second+time.Duration(sizes[0])*time.Millisecond), fakeConn.deadlines[0], time.Second)
+		assert.WithinDuration(start.Add(time.Minute), fakeConn.deadlines[1], time.Second)
+		assert.WithinDuration(start.Add(writeWait), fakeConn.deadlines[2], time.Second)
+	}
+	fakeConn.AssertExpectations(t)
+}
+
+type compressionConnection struct {
+	mockConnection
+	compressed []bool
+}
+
+func (c *compressionConnection) EnableWriteCompression(enable bool) {
+	c.compressed = append(c.compressed, enable)
+}
+
+// test that only the messages reaching CompressionMinSize are compressed
+func TestCompressionMinSize(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &compressionConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Twice()
+
+	testClient := &client{
+		connection: fakeConn,
+		factory:    ClientFactory{CompressionMinSize: 256},
+		Logger:     logging.New(nil),
+	}
+
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test", Payload: make([]byte, 512)}))
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+
+	assert.Equal([]bool{true, false}, fakeConn.compressed)
+	fakeConn.AssertExpectations(t)
+}
+
+func TestMaxSendMessageSize(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+		factory:    ClientFactory{MaxSendMessageSize: 64},
+	}
+
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+
+	err := testClient.Send(wrp.SimpleEvent{Destination: "event:test", Payload: make([]byte, 64)})
+	assert.True(errors.Is(err, ErrMessageTooLarge))
+	fakeConn.AssertExpectations(t)
+}
+
+// test that SendMany tells how far it got
+func TestSendMany(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Twice()
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(ErrFoo).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	msgs := []interface{}{
+		wrp.SimpleEvent{Destination: "event:test/1"},
+		wrp.SimpleEvent{Destination: "event:test/2"},
+		wrp.SimpleEvent{Destination: "event:test/3"},
+		wrp.SimpleEvent{Destination: "event:test/4"},
+	}
+
+	sent, err := testClient.SendMany(context.Background(), msgs)
+	assert.Equal(2, sent)
+	assert.True(errors.Is(err, ErrFoo))
+	assert.Contains(err.Error(), "message 2")
+	fakeConn.AssertExpectations(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sent, err = testClient.SendMany(ctx, msgs)
+	assert.Equal(0, sent)
+	assert.True(errors.Is(err, context.Canceled))
+}
+
+// test that events are sent as a SimpleEvent coming from the device
+func TestSendEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	var sent []byte
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once().Run(func(args mock.Arguments) {
+		sent = args.Get(1).([]byte)
+	})
+
+	testClient := &client{
+		deviceID:   "mac:ffffff112233",
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.SendEvent("event:device-status/mac:ffffff112233/online", []byte("online"))
+	assert.Nil(err)
+
+	var decoded wrp.Message
+	assert.Nil(wrp.NewDecoderBytes(sent, wrp.Msgpack).Decode(&decoded))
+	assert.Equal(wrp.SimpleEventMessageType, decoded.Type)
+	assert.Equal("mac:ffffff112233", decoded.Source)
+	assert.Equal("event:device-status/mac:ffffff112233/online", decoded.Destination)
+	assert.Equal([]byte("online"), decoded.Payload)
+	fakeConn.AssertExpectations(t)
+}
+
+func TestSendFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.TextMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	assert.Nil(testClient.SendFrame(websocket.TextMessage, wrp.SimpleEvent{Destination: "event:test"}))
+
+	err := testClient.SendFrame(websocket.PingMessage, wrp.SimpleEvent{Destination: "event:test"})
+	assert.True(errors.Is(err, ErrInvalidFrameType))
+	fakeConn.AssertExpectations(t)
+}
+
+// timeoutError is a temporary network error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteRetry(t *testing.T) {
+	tests := []struct {
+		description string
+		writeRetry  bool
+		firstErr    error
+		writes      int
+		expectedErr error
+	}{
+		{"temporary not retried", false, timeoutError{}, 1, timeoutError{}},
+		{"permanent", true, websocket.ErrCloseSent, 1, websocket.ErrCloseSent},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fakeConn := &mockConnection{}
+			fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(tc.firstErr).Once()
+			fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+			testClient := &client{
+				connection: fakeConn,
+				factory:    ClientFactory{WriteRetry: tc.writeRetry},
+				Logger:     logging.New(nil),
+			}
+
+			assert.Equal(tc.expectedErr, testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+			fakeConn.AssertNumberOfCalls(t, "WriteMessage", tc.writes)
+		})
+	}
+}
+
+// test that a write timing out on a real websocket, which fails every later
+// write on it, is retried on a new connection
+func TestWriteRetryReconnects(t *testing.T) {
+	assert := assert.New(t)
+
+	var upgrades int32
+	received := make(chan int, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if atomic.AddInt32(&upgrades, 1) == 1 {
+			// the first connection is never read, so writes to it time out
+			<-release
+			return
+		}
+
+		_, message, err := conn.ReadMessage()
+		if err == nil {
+			received <- len(message)
+		}
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	factory := &ClientFactory{
+		DeviceName:        "mac:ffffff112233",
+		DestinationURL:    "http://unused.example.com",
+		ClientLogger:      logging.New(nil),
+		ReconnectStrategy: SameBackend,
+		WriteRetry:        true,
+		WriteDeadlineFunc: func(int) time.Duration { return 5 * time.Second },
+	}
+
+	testClient, err := factory.newClient()
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Nil(testClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil))
+	defer testClient.Close()
+
+	// far more than the socket buffers hold
+	payload := make([]byte, 32<<20)
+	assert.Nil(testClient.SendFrame(websocket.BinaryMessage, payload))
+
+	select {
+	case size := <-received:
+		assert.True(size > len(payload))
+	case <-time.After(30 * time.Second):
+		assert.Fail("the retry didn't reach the new connection")
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&upgrades))
+}
+
+// test that a write failing for good starts a reconnect, gorilla failing every
+// later write on the connection
+func TestWriteErrorReconnects(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(ErrFoo).Once()
+
+	reasons := make(chan string, 10)
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+		shutdown:   make(chan struct{}),
+		headerInfo: &clientHeader{deviceName: "mac:ffffff112233"},
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return nil, errors.New("unreachable")
+			},
+			OnBackoff: func(attempt int, delay time.Duration, why string) {
+				if attempt == 1 {
+					reasons <- why
+				}
+			},
+		},
+	}
+
+	assert.Equal(ErrFoo, testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+	select {
+	case why := <-reasons:
+		assert.Equal(string(ReconnectWriteError), why)
+	case <-time.After(3 * time.Second):
+		assert.Fail("no reconnect")
+	}
+
+	fakeConn.On("Close").Return(nil)
+	assert.Nil(testClient.Close())
+	fakeConn.AssertExpectations(t)
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	// the connection expects no writes at all
+	fakeConn := &mockConnection{}
+	testClient := &client{
+		connection:   fakeConn,
+		factory:      ClientFactory{ReadOnly: true},
+		transactions: make(map[string]*transaction),
+		Logger:       logging.New(nil),
+	}
+
+	assert.Equal(ErrReadOnly, testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+	assert.Equal(ErrReadOnly, testClient.SendEvent("event:test", nil))
+
+	_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:unique"})
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(0, testClient.InflightRequests())
+	fakeConn.AssertExpectations(t)
+}
+
+// test that a client whose connection was never established can be used and
+// closed without panicking
+func TestCloseNeverConnected(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient, err := (&ClientFactory{DeviceName: "mac:ffffff112233", ClientLogger: logging.New(nil)}).newClient()
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.NotPanics(func() {
+		assert.Equal(ErrNotConnected, testClient.read())
+		assert.Equal(ErrNotConnected, testClient.SendEvent("event:test", nil))
+		assert.Nil(testClient.Close())
+	})
+
+	idle := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	assert.NotPanics(func() {
+		idle.checkPing(testClient)
+	})
+	<-idle.done
+}
+
+// test that a wedged shutdown is cut short by the context, and the connection
+// dropped anyway
+func TestCloseCtx(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("Close").Return(nil).Once()
+
+	// done is never closed, as if the ping handler were stuck
+	wedged := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+
+	testClient := &client{
+		connection:  fakeConn,
+		pingHandler: wedged,
+		shutdown:    make(chan struct{}),
+		Logger:      logging.New(nil),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(context.DeadlineExceeded, testClient.CloseCtx(ctx))
+	fakeConn.AssertExpectations(t)
+}
+
+// test that a one-shot event is written before the client closes
+func TestSendAndClose(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	close(stoppedPingHandler.done)
+
+	testClient := &client{
+		connection:  fakeConn,
+		pingHandler: stoppedPingHandler,
+		shutdown:    make(chan struct{}),
+		Logger:      logging.New(nil),
+	}
+
+	err := testClient.SendAndClose(context.Background(), wrp.SimpleEvent{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:ffffff112233/emu",
+		Destination: "event:device-status/bla/bla",
+	})
+
+	assert.Nil(err)
+	fakeConn.AssertExpectations(t)
+}
+
+// test that the close after the send doesn't outlast ctx
+func TestSendAndCloseCtx(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+	fakeConn.On("Close").Return(nil).Once()
+
+	// done is never closed, as if the ping handler were stuck
+	wedged := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+
+	testClient := &client{
+		connection:  fakeConn,
+		pingHandler: wedged,
+		shutdown:    make(chan struct{}),
+		Logger:      logging.New(nil),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := testClient.SendAndClose(ctx, wrp.SimpleEvent{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:ffffff112233/emu",
+		Destination: "event:device-status/bla/bla",
+	})
+
+	assert.Equal(context.DeadlineExceeded, err)
+	fakeConn.AssertExpectations(t)
+}
+
+// test what happens when a websocket fails to write a message
+func TestSendBrokenWriteMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(ErrFoo).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.Send(nil)
+
+	assert.NotNil(err)
+	fakeConn.AssertExpectations(t)
+}
+
+// test the happy path of closing a websocket once we're finished using it
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("Close").Return(nil).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		shutdown:   make(chan struct{}),
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.Close()
+
+	assert.Nil(err)
+	fakeConn.AssertExpectations(t)
+}
+
+// test what happens when we get an error closing the websocket
+func TestCloseBroken(t *testing.T) {
+	assert := assert.New(t)
+	fakeConn := &mockConnection{}
+
+	fakeConn.On("Close").Return(ErrFoo).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		shutdown:   make(chan struct{}),
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.Close()
 
 	assert.NotNil(err)
 	fakeConn.AssertExpectations(t)
@@ -334,7 +1787,7 @@ func TestRead(t *testing.T) {
 	assert := assert.New(t)
 
 	fakeConn := &mockConnection{}
-	fakeConn.On("ReadMessage").Return(0, goodMsg, nil)
+	fakeConn.On("NextReader").Return(websocket.BinaryMessage, goodMsg, nil)
 
 	testClient := &client{
 		deviceID:        testClientFactory.DeviceName,
@@ -355,7 +1808,7 @@ func TestRead(t *testing.T) {
 		Logger:     logging.New(nil),
 	}
 
-	testClient.handlers[0].keyRegex, _ = regexp.Compile(testClient.handlers[0].HandlerKey)
+	testClient.handlers[0].keyMatch, _ = regexp.Compile(testClient.handlers[0].HandlerKey)
 
 	mainWG.Add(1)
 	var err error
@@ -368,3 +1821,578 @@ func TestRead(t *testing.T) {
 	assert.Nil(err)
 	fakeConn.AssertExpectations(t)
 }
+
+// test that the default handler only gets the messages no other handler matched
+func TestReadDefaultHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("NextReader").Return(websocket.BinaryMessage, goodMsg, nil)
+
+	defaultHandler := &myReadHandler{handlerCalled: false}
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{
+				HandlerKey: "/foo",
+				keyMatch:   regexp.MustCompile("/foo"),
+				Handler:    &myReadHandler{handlerCalled: true},
+			},
+		},
+		factory:    ClientFactory{DefaultHandler: defaultHandler},
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	mainWG.Add(1)
+	go testClient.read()
+	mainWG.Wait()
+
+	assert.True(defaultHandler.handlerCalled)
+	fakeConn.AssertExpectations(t)
+}
+
+// test that OnUnmatched only sees the messages no handler would take
+func TestOnUnmatched(t *testing.T) {
+	assert := assert.New(t)
+
+	var unmatched []wrp.Message
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{
+				HandlerKey: "/foo",
+				keyMatch:   regexp.MustCompile("/foo"),
+				Handler:    &myReadHandler{handlerCalled: true},
+			},
+		},
+		factory: ClientFactory{
+			OnUnmatched: func(msg wrp.Message) {
+				unmatched = append(unmatched, msg)
+			},
+		},
+		Logger: logging.New(nil),
+	}
+
+	testClient.dispatch(wrp.Message{Destination: "mac:ffffff112233/bar"}, nil)
+	assert.Equal([]wrp.Message{{Destination: "mac:ffffff112233/bar"}}, unmatched)
+
+	// with a default handler every message is taken
+	testClient.factory.DefaultHandler = &myReadHandler{handlerCalled: true}
+	testClient.dispatch(wrp.Message{Destination: "mac:ffffff112233/baz"}, nil)
+	assert.Len(unmatched, 1)
+}
+
+func TestHandlerRegistryMatches(t *testing.T) {
+	tests := []struct {
+		description string
+		registry    HandlerRegistry
+		msg         wrp.Message
+		expected    bool
+	}{
+		{"destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo")}, wrp.Message{Destination: "/foo"}, true},
+		{"no destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo")}, wrp.Message{Destination: "/bar"}, false},
+		{"header only", HandlerRegistry{HeaderMatch: HasHeader("control")}, wrp.Message{Destination: "/bar", Headers: []string{"control"}}, true},
+		{"header only miss", HandlerRegistry{HeaderMatch: HasHeader("control")}, wrp.Message{Destination: "/bar"}, false},
+		{"header or destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), HeaderMatch: HasHeader("control")}, wrp.Message{Destination: "/bar", Headers: []string{"other", "control"}}, true},
+		{"source and destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), sourceRegex: regexp.MustCompile("^mac:")}, wrp.Message{Destination: "/foo", Source: "mac:ffffff112233"}, true},
+		{"source but not destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), sourceRegex: regexp.MustCompile("^mac:")}, wrp.Message{Destination: "/bar", Source: "mac:ffffff112233"}, false},
+		{"destination but not source", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), sourceRegex: regexp.MustCompile("^mac:")}, wrp.Message{Destination: "/foo", Source: "dns:talaria"}, false},
+		{"source or destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), sourceRegex: regexp.MustCompile("^mac:"), SourceOr: true}, wrp.Message{Destination: "/bar", Source: "mac:ffffff112233"}, true},
+		{"neither source nor destination", HandlerRegistry{keyMatch: regexp.MustCompile("/foo"), sourceRegex: regexp.MustCompile("^mac:"), SourceOr: true}, wrp.Message{Destination: "/bar", Source: "dns:talaria"}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.New(t).Equal(tc.expected, tc.registry.matches(&tc.msg))
+		})
+	}
+}
+
+// leanMessage only decodes what a payload consumer needs
+type leanMessage struct {
+	Destination string `wrp:"dest"`
+	Payload     []byte `wrp:"payload"`
+}
+
+func (l *leanMessage) To() string {
+	return l.Destination
+}
+
+// test that a message that doesn't decode ends the read loop unless it's
+// configured to be skipped
+func TestReadDecodeError(t *testing.T) {
+	tests := []struct {
+		description string
+		skip        bool
+	}{
+		{"stop", false},
+		{"skip", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fakeConn := &mockConnection{}
+			// 0xc1 is never used by msgpack
+			fakeConn.On("NextReader").Return(websocket.BinaryMessage, []byte{0xc1}, nil).Once()
+			fakeConn.On("NextReader").Return(websocket.BinaryMessage, goodMsg, nil)
+			fakeConn.On("Close").Return(nil)
+
+			handler := &decodedHandler{received: make(chan interface{}, 1)}
+			testClient := &client{
+				handlers: []HandlerRegistry{
+					{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+				},
+				factory:    ClientFactory{SkipUndecodableMessages: tc.skip},
+				connection: fakeConn,
+				Logger:     logging.New(nil),
+			}
+
+			if !tc.skip {
+				assert.NotNil(testClient.read())
+				assert.Len(handler.received, 0)
+				fakeConn.AssertNumberOfCalls(t, "NextReader", 1)
+				return
+			}
+
+			go testClient.read()
+			select {
+			case msg := <-handler.received:
+				assert.Equal("/bar", msg.(wrp.Message).Destination)
+			case <-time.After(time.Second):
+				assert.Fail("the message after the bad one wasn't handled")
+			}
+		})
+	}
+}
+
+// errorReader fails part way through a message, as a broken connection would
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// test that a connection failing in the middle of a message ends the read
+// loop even when undecodable messages are skipped
+func TestReadTransportError(t *testing.T) {
+	assert := assert.New(t)
+
+	transportErr := errors.New("connection reset by peer")
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("NextReader").Return(websocket.BinaryMessage, io.MultiReader(bytes.NewReader(goodMsg[:4]), errorReader{transportErr}), nil).Once()
+	fakeConn.On("Close").Return(nil).Once()
+
+	handler := &decodedHandler{received: make(chan interface{}, 1)}
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		factory:    ClientFactory{SkipUndecodableMessages: true},
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	assert.Equal(transportErr, testClient.read())
+	assert.Len(handler.received, 0)
+	fakeConn.AssertExpectations(t)
+}
+
+type blockingHandler struct {
+	unblock chan struct{}
+}
+
+func (b *blockingHandler) HandleMessage(interface{}) {
+	<-b.unblock
+}
+
+// test that a handler blocking past the hard timeout makes the client reconnect
+func TestHandlerHardTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	timedOut := make(chan string, 1)
+	handler := &blockingHandler{unblock: make(chan struct{})}
+	defer close(handler.unblock)
+
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		factory: ClientFactory{
+			HandlerHardTimeout: time.Minute,
+			OnHandlerTimeout: func(handlerKey string) {
+				timedOut <- handlerKey
+			},
+			clock: clock,
+		},
+		Logger: logging.New(nil),
+	}
+
+	go testClient.dispatch(wrp.Message{Destination: "/bar"}, nil)
+
+	// the timeout runs on the clock of the client
+	assert.Equal(time.Minute, <-clock.created)
+	clock.Advance(time.Minute - time.Millisecond)
+	select {
+	case <-timedOut:
+		assert.Fail("the hard timeout fired early")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case handlerKey := <-timedOut:
+		assert.Equal("/bar", handlerKey)
+	case <-time.After(time.Second):
+		assert.Fail("the hard timeout didn't fire")
+	}
+}
+
+type countingHandler struct {
+	blockingHandler
+	running chan struct{}
+}
+
+func (c *countingHandler) HandleMessage(msg interface{}) {
+	c.running <- struct{}{}
+	c.blockingHandler.HandleMessage(msg)
+}
+
+// test that a handler runs at most MaxConcurrency times at once, the messages
+// beyond that being dropped or waiting for their turn
+func TestHandlerMaxConcurrency(t *testing.T) {
+	for _, drop := range []bool{true, false} {
+		t.Run(fmt.Sprintf("DropWhenBusy=%v", drop), func(t *testing.T) {
+			assert := assert.New(t)
+
+			handler := &countingHandler{
+				blockingHandler: blockingHandler{unblock: make(chan struct{})},
+				running:         make(chan struct{}, 3),
+			}
+
+			testClient := &client{
+				handlers: []HandlerRegistry{
+					{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler,
+						MaxConcurrency: 2, DropWhenBusy: drop, slots: make(chan struct{}, 2)},
+				},
+				shutdown: make(chan struct{}),
+				Logger:   logging.New(nil),
+			}
+
+			// the first two don't wait for their handler
+			testClient.dispatch(wrp.Message{Destination: "/bar"}, nil)
+			testClient.dispatch(wrp.Message{Destination: "/bar"}, nil)
+			<-handler.running
+			<-handler.running
+
+			dispatched := make(chan struct{})
+			go func() {
+				testClient.dispatch(wrp.Message{Destination: "/bar"}, nil)
+				close(dispatched)
+			}()
+
+			if drop {
+				<-dispatched
+			} else {
+				select {
+				case <-dispatched:
+					assert.Fail("the third message didn't wait for a free slot")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			close(handler.unblock)
+			<-dispatched
+
+			if drop {
+				assert.Len(handler.running, 0)
+			} else {
+				<-handler.running
+			}
+		})
+	}
+}
+
+type rawCall struct {
+	frameType int
+	raw       []byte
+	msg       wrp.Message
+}
+
+type rawRecorder struct {
+	decodedHandler
+	calls chan rawCall
+}
+
+func (r *rawRecorder) HandleRaw(frameType int, raw []byte, msg wrp.Message) {
+	r.calls <- rawCall{frameType, raw, msg}
+}
+
+// test that a RawReadHandler gets the frame type and bytes of a message
+// along with the decoded message
+func TestReadRawReadHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("NextReader").Return(websocket.TextMessage, goodMsg, nil)
+
+	handler := &rawRecorder{
+		decodedHandler: decodedHandler{received: make(chan interface{}, 1)},
+		calls:          make(chan rawCall, 1),
+	}
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	go testClient.read()
+
+	select {
+	case call := <-handler.calls:
+		assert.Equal(websocket.TextMessage, call.frameType)
+		assert.Equal(goodMsg, call.raw)
+		assert.Equal("/bar", call.msg.Destination)
+	case <-time.After(time.Second):
+		assert.Fail("HandleRaw wasn't called")
+	}
+
+	assert.Len(handler.received, 0)
+}
+
+type decodedHandler struct {
+	received chan interface{}
+}
+
+func (d *decodedHandler) HandleMessage(msg interface{}) {
+	d.received <- msg
+}
+
+func TestReadDecodeInto(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("NextReader").Return(websocket.BinaryMessage, goodMsg, nil)
+
+	handler := &decodedHandler{received: make(chan interface{}, 1)}
+	testClient := &client{
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		factory: ClientFactory{
+			DecodeInto: func() interface{} { return new(leanMessage) },
+		},
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	go testClient.read()
+
+	msg := <-handler.received
+	if assert.IsType(&leanMessage{}, msg) {
+		assert.Equal("/bar", msg.(*leanMessage).Destination)
+		assert.Equal([]byte("the payload has reached the checkpoint"), msg.(*leanMessage).Payload)
+	}
+}
+
+func TestReadRawHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("NextReader").Return(websocket.BinaryMessage, bytes.NewReader(goodMsg), nil).Once()
+	fakeConn.On("NextReader").Return(0, bytes.NewReader(nil), io.EOF)
+	fakeConn.On("Close").Return(nil)
+
+	var raw [][]byte
+	testClient := &client{
+		factory: ClientFactory{
+			RawHandler: func(message []byte) { raw = append(raw, message) },
+		},
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.read()
+
+	assert.Equal(io.EOF, err)
+	assert.Equal([][]byte{goodMsg}, raw)
+}
+
+// receivedHandler passes on the messages it's given
+type receivedHandler struct {
+	received chan interface{}
+}
+
+func (h *receivedHandler) HandleMessage(msg interface{}) {
+	h.received <- msg
+}
+
+// test that a message sent as several frames is reassembled before it is
+// decoded, and that MaxMessageSize applies to the whole of it
+func TestReadFragmented(t *testing.T) {
+	var buf bytes.Buffer
+	wrp.NewEncoder(&buf, wrp.Msgpack).Encode(wrp.SimpleRequestResponse{
+		Source:          "mac:ffffff112233/emu",
+		Destination:     "/bar",
+		TransactionUUID: "emu:unique",
+		Payload:         bytes.Repeat([]byte("k"), 4*maxMessageSize),
+	})
+	bigMsg := buf.Bytes()
+
+	tests := []struct {
+		description    string
+		maxMessageSize int64
+		handled        bool
+	}{
+		{"within the limit", int64(2 * len(bigMsg)), true},
+		{"over the default limit", 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// the writes fill the small buffer, each being flushed as a frame
+			fragmenter := &websocket.Upgrader{WriteBufferSize: 512}
+			closed := make(chan error, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := fragmenter.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				writer, err := conn.NextWriter(websocket.BinaryMessage)
+				if err != nil {
+					return
+				}
+				for i := 0; i < len(bigMsg); i += 1000 {
+					end := i + 1000
+					if end > len(bigMsg) {
+						end = len(bigMsg)
+					}
+					writer.Write(bigMsg[i:end])
+				}
+				writer.Close()
+
+				_, _, err = conn.ReadMessage()
+				closed <- err
+			}))
+			defer backend.Close()
+
+			handler := &receivedHandler{received: make(chan interface{}, 1)}
+			factory := &ClientFactory{
+				DeviceName:     "mac:ffffff112233",
+				DestinationURL: "http://unused.example.com",
+				ClientLogger:   logging.New(nil),
+				MaxMessageSize: tc.maxMessageSize,
+				Handlers:       []HandlerRegistry{{HandlerKey: "/bar", Handler: handler}},
+			}
+
+			testClient, err := factory.newClient()
+			if !assert.Nil(err) {
+				return
+			}
+			if !assert.Nil(testClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil)) {
+				return
+			}
+			defer testClient.Close()
+
+			if tc.handled {
+				select {
+				case msg := <-handler.received:
+					if assert.IsType(wrp.Message{}, msg) {
+						assert.Equal(4*maxMessageSize, len(msg.(wrp.Message).Payload))
+					}
+				case <-time.After(3 * time.Second):
+					assert.Fail("the message wasn't handled")
+				}
+				return
+			}
+
+			// the client refuses the message as a whole
+			select {
+			case err := <-closed:
+				assert.True(websocket.IsCloseError(err, websocket.CloseMessageTooBig))
+			case <-time.After(3 * time.Second):
+				assert.Fail("the connection wasn't closed")
+			}
+			assert.Empty(handler.received)
+		})
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int64(maxMessageSize), (&ClientFactory{}).readLimit())
+	assert.Equal(int64(65536), (&ClientFactory{MaxMessageSize: 65536}).readLimit())
+	assert.Equal(int64(0), (&ClientFactory{MaxMessageSize: -1}).readLimit())
+}
+
+// discardConnection is a websocketConnection without any of the mock
+// bookkeeping, so benchmarks only measure kratos itself
+type discardConnection struct {
+	message   []byte
+	remaining int
+}
+
+func (d *discardConnection) WriteMessage(messageType int, data []byte) error {
+	return nil
+}
+
+func (d *discardConnection) NextReader() (int, io.Reader, error) {
+	if d.remaining <= 0 {
+		return 0, nil, io.EOF
+	}
+	d.remaining--
+	return websocket.BinaryMessage, bytes.NewReader(d.message), nil
+}
+
+func (d *discardConnection) Close() error {
+	return nil
+}
+
+func BenchmarkSend(b *testing.B) {
+	testClient := &client{
+		connection: &discardConnection{},
+		Logger:     logging.New(nil),
+	}
+
+	myMessage := wrp.SimpleRequestResponse{
+		Source:          "mac:ffffff112233/emu",
+		Destination:     "event:device-status/bla/bla",
+		TransactionUUID: "emu:unique",
+		Payload:         []byte("the payload has reached the checkpoint"),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		testClient.Send(myMessage)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	testClient := &client{
+		connection: &discardConnection{message: goodMsg, remaining: b.N},
+		handlers: []HandlerRegistry{
+			{
+				HandlerKey: "/bar",
+				keyMatch:   regexp.MustCompile("/bar"),
+				Handler:    &myReadHandler{handlerCalled: true},
+			},
+		},
+		Logger: logging.New(nil),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	testClient.read()
+}
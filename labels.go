@@ -0,0 +1,38 @@
+package kratos
+
+import "sort"
+
+// LabeledMetrics is implemented by Metrics that can attach the
+// ClientFactory.Labels to everything they record
+type LabeledMetrics interface {
+	Metrics
+
+	// WithLabels returns the Metrics recording with labels.
+	WithLabels(labels map[string]string) Metrics
+}
+
+// copyLabels returns a copy of labels so that changing the factory's map
+// after New has no effect on the client
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// labelKeyvals turns labels into logger key/values, sorted by key so log lines
+// are consistent
+func labelKeyvals(labels map[string]string) []interface{} {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	keyvals := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		keyvals = append(keyvals, k, labels[k])
+	}
+	return keyvals
+}
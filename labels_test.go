@@ -0,0 +1,45 @@
+package kratos
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type labeledMetrics struct {
+	nopMetrics
+	labels map[string]string
+}
+
+func (l *labeledMetrics) WithLabels(labels map[string]string) Metrics {
+	return &labeledMetrics{labels: labels}
+}
+
+func TestLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	var logged []interface{}
+	labels := map[string]string{"tenant": "acme", "partner": "comcast"}
+
+	factory := &ClientFactory{
+		DeviceName: "mac:ffffff112233",
+		ClientLogger: log.LoggerFunc(func(keyvals ...interface{}) error {
+			logged = keyvals
+			return nil
+		}),
+		Metrics: &labeledMetrics{},
+		Labels:  labels,
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+
+	labels["tenant"] = "changed"
+
+	testClient.Log("msg", "hello")
+	assert.Equal([]interface{}{"partner", "comcast", "tenant", "acme", "connectionID", "", "msg", "hello"}, logged)
+
+	metrics := testClient.factory.Metrics.(*labeledMetrics)
+	assert.Equal(map[string]string{"tenant": "acme", "partner": "comcast"}, metrics.labels)
+}
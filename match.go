@@ -0,0 +1,95 @@
+package kratos
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MatchMode tells how the HandlerKey of a handler is matched against the WRP
+// destination of messages
+type MatchMode int
+
+const (
+	// MatchRegexp treats keys as regular expressions found anywhere in the
+	// destination, so the dot of /foo/bar.baz matches any character. It's the
+	// default.
+	MatchRegexp MatchMode = iota
+
+	// MatchPrefix matches destinations whose path, from the first slash on,
+	// starts with the key taken literally, /config matching
+	// mac:112233/config/wifi.
+	MatchPrefix
+
+	// MatchGlob matches destinations whose whole path, from the first slash
+	// on, matches the key as a path.Match pattern, where * stands for any run
+	// of characters but a slash and ? for any single one, /config/* matching
+	// mac:112233/config/wifi but not mac:112233/config/wifi/ssid.
+	MatchGlob
+)
+
+// keyMatcher matches a handler key against destinations. *regexp.Regexp is
+// the one of MatchRegexp.
+type keyMatcher interface {
+	MatchString(destination string) bool
+
+	// LiteralPrefix returns the literal text every match starts with, and
+	// whether that is the whole of the key, which AnalyzeHandlers tries as a
+	// destination.
+	LiteralPrefix() (prefix string, complete bool)
+}
+
+// compile turns a handler key into the matcher of the mode
+func (m MatchMode) compile(key string) (keyMatcher, error) {
+	switch m {
+	case MatchPrefix:
+		return prefixMatcher(key), nil
+	case MatchGlob:
+		// path.Match only reports a malformed pattern, whatever the name
+		if _, err := path.Match(key, ""); err != nil {
+			return nil, err
+		}
+		return globMatcher(key), nil
+	default:
+		expr, err := regexp.Compile(key)
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+}
+
+// destinationPath is the part of destination from the first slash on, past
+// the device locator such as mac:112233 or event:device-status
+func destinationPath(destination string) string {
+	if i := strings.IndexByte(destination, '/'); i >= 0 {
+		return destination[i:]
+	}
+	return ""
+}
+
+// prefixMatcher is a MatchPrefix key
+type prefixMatcher string
+
+func (p prefixMatcher) MatchString(destination string) bool {
+	return strings.HasPrefix(destinationPath(destination), string(p))
+}
+
+func (p prefixMatcher) LiteralPrefix() (string, bool) {
+	return string(p), true
+}
+
+// globMatcher is a MatchGlob key, already checked to be a valid pattern
+type globMatcher string
+
+func (g globMatcher) MatchString(destination string) bool {
+	matched, _ := path.Match(string(g), destinationPath(destination))
+	return matched
+}
+
+func (g globMatcher) LiteralPrefix() (string, bool) {
+	if i := strings.IndexAny(string(g), `*?[\`); i >= 0 {
+		return string(g[:i]), false
+	}
+	return string(g), true
+}
@@ -0,0 +1,47 @@
+package kratos
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchMode(t *testing.T) {
+	tests := []struct {
+		mode        MatchMode
+		key         string
+		destination string
+		matches     bool
+	}{
+		{MatchRegexp, "/foo/bar.baz", "mac:112233/foo/barXbaz", true},
+		{MatchPrefix, "/foo/bar.baz", "mac:112233/foo/barXbaz", false},
+		{MatchPrefix, "/foo/bar.baz", "mac:112233/foo/bar.baz/qux", true},
+		{MatchPrefix, "/config", "mac:112233/config/wifi", true},
+		{MatchPrefix, "/config", "mac:112233/other/config", false},
+		{MatchGlob, "/config/*", "mac:112233/config/wifi", true},
+		{MatchGlob, "/config/*", "mac:112233/config/wifi/ssid", false},
+		{MatchGlob, "/config/wif?", "mac:112233/config/wifi", true},
+		{MatchGlob, "/config/w.*", "mac:112233/config/wifi", false},
+		{MatchGlob, "/*/online", "event:device-status/mac:112233/online", true},
+		{MatchGlob, "/config/[vw]ifi", "mac:112233/config/wifi", true},
+		{MatchPrefix, "/config", "mac:112233", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d %s %s", tc.mode, tc.key, tc.destination), func(t *testing.T) {
+			assert := assert.New(t)
+
+			keyMatch, err := tc.mode.compile(tc.key)
+			if assert.Nil(err) {
+				assert.Equal(tc.matches, keyMatch.MatchString(tc.destination))
+			}
+		})
+	}
+}
+
+func TestMatchModeBadGlob(t *testing.T) {
+	_, err := MatchGlob.compile("/config/[wifi")
+	assert.Equal(t, path.ErrBadPattern, err)
+}
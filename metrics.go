@@ -0,0 +1,62 @@
+package kratos
+
+import (
+	"strings"
+	"time"
+)
+
+// Metrics receives the measurements taken by a client, so they can be fed to
+// whatever monitoring system the device uses
+type Metrics interface {
+	// ObserveDiscoveryLatency is called with how long the request to petasos
+	// took, redirect included.
+	ObserveDiscoveryLatency(time.Duration)
+
+	// ObserveDialLatency is called with how long the websocket dial and
+	// handshake with the backend took.
+	ObserveDialLatency(time.Duration)
+
+	// IncMessagesReceivedFor is called for every message received with the
+	// service it is for, as returned by destinationService, which keeps the
+	// number of distinct values low.
+	IncMessagesReceivedFor(service string)
+}
+
+// nopMetrics is used when the factory has no Metrics
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveDiscoveryLatency(time.Duration) {}
+func (nopMetrics) ObserveDialLatency(time.Duration)      {}
+func (nopMetrics) IncMessagesReceivedFor(string)         {}
+
+func (f *ClientFactory) metrics() Metrics {
+	if f.Metrics != nil {
+		return f.Metrics
+	}
+	return nopMetrics{}
+}
+
+// destinationService reduces a WRP destination to the service it is for,
+// leaving out the device or instance part of the locator: the event name for
+// "event:device-status/mac:112233/online" and the first path segment for
+// "mac:112233/config/wifi" or "/config". It is empty when there is neither.
+func destinationService(destination string) string {
+	if strings.HasPrefix(destination, "event:") {
+		event := destination[len("event:"):]
+		if i := strings.IndexByte(event, '/'); i >= 0 {
+			event = event[:i]
+		}
+		return event
+	}
+
+	i := strings.IndexByte(destination, '/')
+	if i < 0 {
+		return ""
+	}
+
+	service := destination[i+1:]
+	if j := strings.IndexByte(service, '/'); j >= 0 {
+		service = service[:j]
+	}
+	return service
+}
@@ -0,0 +1,96 @@
+package kratos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type mockMetrics struct {
+	mock.Mock
+}
+
+func (m *mockMetrics) ObserveDiscoveryLatency(latency time.Duration) {
+	m.Called(latency)
+}
+
+func (m *mockMetrics) ObserveDialLatency(latency time.Duration) {
+	m.Called(latency)
+}
+
+func (m *mockMetrics) IncMessagesReceivedFor(service string) {
+	m.Called(service)
+}
+
+// test that discovery and the dial are timed separately
+func TestConnectLatencyMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	defer backend.Close()
+
+	petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+	}))
+	defer petasos.Close()
+
+	metrics := &mockMetrics{}
+	metrics.On("ObserveDiscoveryLatency", mock.AnythingOfType("time.Duration")).Return().Once().Run(func(args mock.Arguments) {
+		assert.True(args.Get(0).(time.Duration) >= 10*time.Millisecond)
+	})
+	metrics.On("ObserveDialLatency", mock.AnythingOfType("time.Duration")).Return().Once()
+
+	testClient, err := (&ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: petasos.URL,
+		ClientLogger:   logging.New(nil),
+		Metrics:        metrics,
+	}).New()
+
+	assert.Nil(err)
+	metrics.AssertExpectations(t)
+
+	if testClient != nil {
+		testClient.Close()
+	}
+}
+
+func TestDestinationService(t *testing.T) {
+	tests := []struct {
+		destination string
+		expected    string
+	}{
+		{"event:device-status/mac:ffffff112233/online", "device-status"},
+		{"event:reboot", "reboot"},
+		{"mac:ffffff112233/config/wifi", "config"},
+		{"dns:talaria.example.com/config", "config"},
+		{"/bar", "bar"},
+		{"mac:ffffff112233", ""},
+		{"", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.destination, func(t *testing.T) {
+			assert.New(t).Equal(tc.expected, destinationService(tc.destination))
+		})
+	}
+}
+
+func TestIncMessagesReceivedFor(t *testing.T) {
+	metrics := &mockMetrics{}
+	metrics.On("IncMessagesReceivedFor", "config").Return().Once()
+
+	testClient := &client{factory: ClientFactory{Metrics: metrics}}
+	testClient.dispatch(wrp.Message{Destination: "mac:ffffff112233/config/wifi"}, nil)
+
+	metrics.AssertExpectations(t)
+}
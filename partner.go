@@ -0,0 +1,188 @@
+package kratos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// ErrPartnerClient is returned by the methods of a partner client that would
+// tear down the connection it shares
+var ErrPartnerClient = errors.New("not supported by a partner client")
+
+// partnerClient is a Client sharing the connection of another, whose messages
+// all carry its partner id
+type partnerClient struct {
+	*client
+	partnerID string
+}
+
+// ForPartner returns a lightweight Client bound to partnerID, sharing this
+// client's connection. Every message it sends carries partnerID among its
+// partner ids, while the messages read still go through the handlers of this
+// client. Closing it does nothing, the connection being closed along with
+// this client, and exporting its connection fails with ErrPartnerClient. Since
+// WRPVersion1 has no partner ids, its sends fail with that version.
+func (c *client) ForPartner(partnerID string) Client {
+	return &partnerClient{client: c, partnerID: partnerID}
+}
+
+// ForPartner returns the partner client itself, which keeps its partner id
+func (p *partnerClient) ForPartner(string) Client {
+	return p
+}
+
+// stamp returns message with the partner id added. Messages of types other
+// than those of wrp-go are turned into a wrp.Message through their encoding.
+func (p *partnerClient) stamp(message interface{}) interface{} {
+	switch msg := message.(type) {
+	case wrp.Message:
+		msg.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return msg
+	case *wrp.Message:
+		stamped := *msg
+		stamped.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return &stamped
+	case wrp.SimpleEvent:
+		msg.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return msg
+	case *wrp.SimpleEvent:
+		stamped := *msg
+		stamped.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return &stamped
+	case wrp.SimpleRequestResponse:
+		msg.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return msg
+	case *wrp.SimpleRequestResponse:
+		stamped := *msg
+		stamped.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+		return &stamped
+	}
+
+	var encoded []byte
+	if err := wrp.NewEncoderBytes(&encoded, wrp.Msgpack).Encode(message); err != nil {
+		// sending it fails the same way
+		return message
+	}
+
+	var msg wrp.Message
+	if err := wrp.NewDecoderBytes(encoded, wrp.Msgpack).Decode(&msg); err != nil {
+		return message
+	}
+	msg.PartnerIDs = p.partnerIDs(msg.PartnerIDs)
+	return msg
+}
+
+// partnerIDs returns a copy of partnerIDs with the partner id added, unless it
+// is there already
+func (p *partnerClient) partnerIDs(partnerIDs []string) []string {
+	for _, id := range partnerIDs {
+		if id == p.partnerID {
+			return partnerIDs
+		}
+	}
+	return append(append([]string(nil), partnerIDs...), p.partnerID)
+}
+
+func (p *partnerClient) NewMessage() *MessageBuilder {
+	return p.client.NewMessage().Partner(p.partnerID)
+}
+
+func (p *partnerClient) Send(message interface{}) error {
+	return p.client.Send(p.stamp(message))
+}
+
+func (p *partnerClient) SendWithDeadline(d time.Duration, message interface{}) error {
+	return p.client.SendWithDeadline(d, p.stamp(message))
+}
+
+func (p *partnerClient) TrySend(message interface{}) error {
+	return p.client.TrySend(p.stamp(message))
+}
+
+func (p *partnerClient) SendMany(ctx context.Context, msgs []interface{}) (int, error) {
+	stamped := make([]interface{}, len(msgs))
+	for i, message := range msgs {
+		stamped[i] = p.stamp(message)
+	}
+	return p.client.SendMany(ctx, stamped)
+}
+
+func (p *partnerClient) SendSticky(destination string, message interface{}) error {
+	return p.client.SendSticky(destination, p.stamp(message))
+}
+
+func (p *partnerClient) SendStream(destination string, r io.Reader, chunkSize int) error {
+	return p.client.sendStream(p.Send, destination, "application/octet-stream", r, chunkSize)
+}
+
+func (p *partnerClient) SendFile(destination, path, contentType string) error {
+	return p.client.sendFile(p.Send, destination, path, contentType)
+}
+
+func (p *partnerClient) SendPriority(priority Priority, message interface{}) error {
+	return p.client.SendPriority(priority, p.stamp(message))
+}
+
+func (p *partnerClient) SendFrame(frameType int, message interface{}) error {
+	return p.client.SendFrame(frameType, p.stamp(message))
+}
+
+func (p *partnerClient) SendEvent(destination string, payload []byte) error {
+	return p.Send(wrp.SimpleEvent{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      p.deviceID,
+		Destination: destination,
+		Payload:     payload,
+	})
+}
+
+func (p *partnerClient) SendWithResponse(ctx context.Context, message wrp.Message, options ...RequestOption) (wrp.Message, error) {
+	return p.client.SendWithResponse(ctx, p.stamp(message).(wrp.Message), options...)
+}
+
+func (p *partnerClient) SendConfirmed(ctx context.Context, message wrp.Message, options ...RequestOption) error {
+	return p.client.SendConfirmed(ctx, p.stamp(message).(wrp.Message), options...)
+}
+
+// SendAndClose only sends message, waiting for the response of a request,
+// since closing a partner client does nothing
+func (p *partnerClient) SendAndClose(ctx context.Context, message interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if msg, ok := message.(wrp.Message); ok && msg.Type == wrp.SimpleRequestResponseMessageType && msg.TransactionUUID != "" {
+		_, err := p.SendWithResponse(ctx, msg)
+		return err
+	}
+	return p.Send(message)
+}
+
+// Close leaves the shared connection open
+func (p *partnerClient) Close() error {
+	return nil
+}
+
+// CloseCtx leaves the shared connection open
+func (p *partnerClient) CloseCtx(context.Context) error {
+	return nil
+}
+
+// CloseDrain leaves the shared connection open
+func (p *partnerClient) CloseDrain(context.Context) error {
+	return nil
+}
+
+// CloseWithReport leaves the shared connection open, nothing is lost
+func (p *partnerClient) CloseWithReport(context.Context) (CloseReport, error) {
+	return CloseReport{}, nil
+}
+
+// ExportConnection leaves the shared connection with the client it belongs to
+func (p *partnerClient) ExportConnection() (*ExportedConnection, error) {
+	return nil, ErrPartnerClient
+}
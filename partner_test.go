@@ -0,0 +1,63 @@
+package kratos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type partnerMessage struct {
+	Destination string `wrp:"dest"`
+}
+
+// test that a partner client stamps its messages and leaves the connection
+// open when closed
+func TestForPartner(t *testing.T) {
+	assert := assert.New(t)
+
+	connection := &channelConnection{written: make(chan []byte, 10)}
+	testClient := &client{
+		connection: connection,
+		deviceID:   "mac:ffffff112233",
+		shutdown:   make(chan struct{}),
+		Logger:     logging.New(nil),
+	}
+
+	partner := testClient.ForPartner("comcast")
+	sent := func() wrp.Message {
+		var msg wrp.Message
+		assert.Nil(wrp.NewDecoderBytes(<-connection.written, wrp.Msgpack).Decode(&msg))
+		return msg
+	}
+
+	assert.Nil(partner.Send(wrp.SimpleEvent{Destination: "event:test", PartnerIDs: []string{"other"}}))
+	assert.Equal([]string{"other", "comcast"}, sent().PartnerIDs)
+
+	assert.Nil(partner.SendEvent("event:test", nil))
+	assert.Equal([]string{"comcast"}, sent().PartnerIDs)
+
+	assert.Nil(partner.Send(&wrp.Message{Destination: "event:test", PartnerIDs: []string{"comcast"}}))
+	assert.Equal([]string{"comcast"}, sent().PartnerIDs)
+
+	assert.Nil(partner.Send(partnerMessage{Destination: "event:test"}))
+	msg := sent()
+	assert.Equal("event:test", msg.Destination)
+	assert.Equal([]string{"comcast"}, msg.PartnerIDs)
+
+	assert.Equal([]string{"comcast"}, partner.NewMessage().Build().PartnerIDs)
+
+	// the shared client is untouched
+	assert.Nil(partner.Close())
+	exported, err := partner.ExportConnection()
+	assert.Nil(exported)
+	assert.Equal(ErrPartnerClient, err)
+	assert.False(testClient.closing())
+	assert.Nil(testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+	assert.Empty(sent().PartnerIDs)
+
+	// a partner client keeps its partner id
+	assert.Nil(partner.ForPartner("other").Send(wrp.SimpleEvent{Destination: "event:test"}))
+	assert.Equal([]string{"comcast"}, sent().PartnerIDs)
+}
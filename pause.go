@@ -0,0 +1,86 @@
+package kratos
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// defaultPauseBufferSize is how many messages are held while dispatch is
+// paused when PauseBufferSize isn't set
+const defaultPauseBufferSize = 1024
+
+// dispatchPause holds the messages read while dispatch is paused
+type dispatchPause struct {
+	lock   sync.Mutex
+	paused bool
+	held   []inbound
+}
+
+// PauseDispatch stops handing messages to the handlers, for instance while
+// the application reloads its configuration. The connection stays up and
+// messages keep being read, held until ResumeDispatch, responses to
+// SendWithResponse included. Up to PauseBufferSize messages are held, those
+// arriving once it is reached are dropped and logged. Messages still held
+// when the client is closed are lost, as counted by CloseWithReport.
+func (c *client) PauseDispatch() {
+	c.pause.lock.Lock()
+	c.pause.paused = true
+	c.pause.lock.Unlock()
+}
+
+// ResumeDispatch hands the messages held since PauseDispatch to the handlers,
+// in the order they were read and before any message read from then on, and
+// goes back to dispatching messages as they are read. The held messages are
+// dispatched by the caller, which returns once they all are.
+func (c *client) ResumeDispatch() {
+	var decoder wrp.Decoder
+	for {
+		c.pause.lock.Lock()
+		held := c.pause.held
+		c.pause.held = nil
+		if len(held) == 0 {
+			// nothing was read in the meantime, later messages can go
+			// straight to the handlers
+			c.pause.paused = false
+			c.pause.lock.Unlock()
+			return
+		}
+		c.pause.lock.Unlock()
+
+		for _, m := range held {
+			atomic.AddInt32(&c.unprocessed, -1)
+			// a message that doesn't decode has already been logged, and
+			// there is no read loop here to end
+			c.dispatchFrame(&decoder, m.frameType, m.raw)
+		}
+	}
+}
+
+// hold keeps a message read while dispatch is paused, telling whether it
+// did. It's dropped when the buffer is full.
+func (c *client) hold(frameType int, raw []byte) bool {
+	c.pause.lock.Lock()
+	defer c.pause.lock.Unlock()
+
+	if !c.pause.paused {
+		return false
+	}
+
+	size := c.factory.PauseBufferSize
+	if size <= 0 {
+		size = defaultPauseBufferSize
+	}
+
+	if len(c.pause.held) >= size {
+		logging.Warn(c).Log(logging.MessageKey(), "Dispatch is paused and its buffer is full, dropping message",
+			"pauseBufferSize", size)
+		return true
+	}
+
+	c.pause.held = append(c.pause.held, inbound{frameType: frameType, raw: raw})
+	atomic.AddInt32(&c.unprocessed, 1)
+	return true
+}
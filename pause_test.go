@@ -0,0 +1,41 @@
+package kratos
+
+import (
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// test that the messages read while dispatch is paused are held, up to the
+// buffer size, and handed to the handlers on resume
+func TestPauseDispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &countHandler{}
+	testClient := &client{
+		connection: &discardConnection{message: goodMsg, remaining: 5},
+		handlers: []HandlerRegistry{
+			{HandlerKey: "/bar", keyMatch: regexp.MustCompile("/bar"), Handler: handler},
+		},
+		factory: ClientFactory{PauseBufferSize: 3},
+		Logger:  logging.New(nil),
+	}
+
+	testClient.PauseDispatch()
+	testClient.read()
+	assert.Zero(handler.count)
+	assert.Equal(int32(3), atomic.LoadInt32(&testClient.unprocessed))
+
+	testClient.ResumeDispatch()
+	assert.Equal(3, handler.count)
+	assert.Zero(atomic.LoadInt32(&testClient.unprocessed))
+
+	var decoder wrp.Decoder
+	assert.Nil(testClient.process(&decoder, websocket.BinaryMessage, goodMsg))
+	assert.Equal(4, handler.count)
+}
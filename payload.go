@@ -0,0 +1,72 @@
+package kratos
+
+import (
+	"mime"
+
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// PayloadReadHandler can be implemented by a ReadHandler that wants the
+// payload of its messages already decoded, by the codec registered with
+// RegisterPayloadCodec for their content type. NewPayload returns what a
+// payload is decoded into, given to HandlePayload along with its message.
+// Messages with a content type no codec was registered for, or whose payload
+// fails to decode, are given to HandleMessage instead. RawReadHandler takes
+// precedence when both are implemented.
+type PayloadReadHandler interface {
+	ReadHandler
+	NewPayload() interface{}
+	HandlePayload(msg wrp.Message, payload interface{})
+}
+
+// RegisterPayloadCodec sets how the payloads of the messages with
+// contentType are decoded for a PayloadReadHandler, json.Unmarshal being the
+// typical decode. Parameters of the content type, like a charset, are ignored
+// when looking the codec up. Registering a nil decode removes the codec.
+func (c *client) RegisterPayloadCodec(contentType string, decode func([]byte, interface{}) error) {
+	contentType = mediaType(contentType)
+
+	c.codecLock.Lock()
+	defer c.codecLock.Unlock()
+
+	if decode == nil {
+		delete(c.codecs, contentType)
+		return
+	}
+
+	if c.codecs == nil {
+		c.codecs = make(map[string]func([]byte, interface{}) error)
+	}
+	c.codecs[contentType] = decode
+}
+
+// handlePayload decodes the payload of msg for handler and calls it, telling
+// whether it did
+func (c *client) handlePayload(handler PayloadReadHandler, msg wrp.Message) bool {
+	c.codecLock.RLock()
+	decode := c.codecs[mediaType(msg.ContentType)]
+	c.codecLock.RUnlock()
+
+	if decode == nil {
+		return false
+	}
+
+	payload := handler.NewPayload()
+	if err := decode(msg.Payload, payload); err != nil {
+		logging.Error(c).Log(logging.MessageKey(), "Failed to decode payload",
+			"contentType", msg.ContentType, "destination", msg.Destination, logging.ErrorKey(), err)
+		return false
+	}
+
+	handler.HandlePayload(msg, payload)
+	return true
+}
+
+// mediaType strips the parameters off contentType
+func mediaType(contentType string) string {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		return parsed
+	}
+	return contentType
+}
@@ -0,0 +1,65 @@
+package kratos
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+type status struct {
+	Online bool `json:"online"`
+}
+
+type payloadHandler struct {
+	payload interface{}
+	msg     interface{}
+}
+
+func (h *payloadHandler) HandleMessage(msg interface{}) {
+	h.msg = msg
+}
+
+func (h *payloadHandler) NewPayload() interface{} {
+	return &status{}
+}
+
+func (h *payloadHandler) HandlePayload(msg wrp.Message, payload interface{}) {
+	h.payload = payload
+}
+
+// test that a PayloadReadHandler gets payloads decoded by their codec, and
+// HandleMessage is called for the others
+func TestPayloadReadHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{Logger: logging.New(nil)}
+	testClient.RegisterPayloadCodec("application/json", json.Unmarshal)
+
+	handler := &payloadHandler{}
+	testClient.handle("/bar", handler, wrp.Message{
+		ContentType: "application/json; charset=utf-8",
+		Payload:     []byte(`{"online":true}`),
+	}, nil)
+	assert.Equal(&status{Online: true}, handler.payload)
+	assert.Nil(handler.msg)
+
+	handler = &payloadHandler{}
+	undecodable := wrp.Message{ContentType: "application/json", Payload: []byte("{")}
+	testClient.handle("/bar", handler, undecodable, nil)
+	assert.Nil(handler.payload)
+	assert.Equal(undecodable, handler.msg)
+
+	handler = &payloadHandler{}
+	unknown := wrp.Message{ContentType: "application/msgpack", Payload: []byte{0x80}}
+	testClient.handle("/bar", handler, unknown, nil)
+	assert.Nil(handler.payload)
+	assert.Equal(unknown, handler.msg)
+
+	testClient.RegisterPayloadCodec("application/json", nil)
+	handler = &payloadHandler{}
+	testClient.handle("/bar", handler, wrp.Message{ContentType: "application/json", Payload: []byte("{}")}, nil)
+	assert.Nil(handler.payload)
+}
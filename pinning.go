@@ -0,0 +1,28 @@
+package kratos
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// ErrCertificateNotPinned is returned when connecting to a server whose
+// certificates match none of the PinnedCertFingerprints
+var ErrCertificateNotPinned = errors.New("server certificate doesn't match any pinned fingerprint")
+
+// verifyPinned is the VerifyPeerCertificate callback checking that one of the
+// certificates presented by the server, its leaf or one of the chain, has one
+// of the PinnedCertFingerprints
+func (f *ClientFactory) verifyPinned(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, raw := range rawCerts {
+		fingerprint := sha256.Sum256(raw)
+		for _, pinned := range f.PinnedCertFingerprints {
+			if fingerprint == pinned {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %d certificate(s) presented", ErrCertificateNotPinned, len(rawCerts))
+}
@@ -0,0 +1,28 @@
+package kratos
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPinned(t *testing.T) {
+	assert := assert.New(t)
+
+	leaf, intermediate := []byte("leaf certificate"), []byte("intermediate certificate")
+	factory := &ClientFactory{PinnedCertFingerprints: [][32]byte{sha256.Sum256(intermediate)}}
+
+	assert.Nil(factory.verifyPinned([][]byte{leaf, intermediate}, nil))
+
+	err := factory.verifyPinned([][]byte{leaf}, nil)
+	assert.True(errors.Is(err, ErrCertificateNotPinned))
+
+	// both discovery and the dial check the pins
+	client, dialer, err := factory.transport()
+	if assert.Nil(err) {
+		assert.NotNil(dialer.TLSClientConfig.VerifyPeerCertificate)
+		assert.NotNil(client.Transport)
+	}
+}
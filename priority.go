@@ -0,0 +1,103 @@
+package kratos
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrWouldBlock is returned by TrySend when the message can't be written
+// without waiting for others
+var ErrWouldBlock = errors.New("send would block")
+
+// Priority orders the messages waiting to be written
+type Priority int
+
+const (
+	// PriorityNormal is the priority of everything sent with Send, such as
+	// bulk telemetry.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh messages, like acks or shutdown notices, are written
+	// ahead of any PriorityNormal message waiting.
+	PriorityHigh
+)
+
+// maxHighStreak is how many PriorityHigh messages may go ahead in a row of a
+// waiting PriorityNormal message, so that a steady flow of high priority
+// messages can't starve the others.
+const maxHighStreak = 8
+
+// sendQueue lines up the senders waiting for their turn to write, in one
+// queue per priority. The high priority queue is served first, but once in a
+// while the normal one is served anyway. The zero value is ready to use.
+type sendQueue struct {
+	lock       sync.Mutex
+	busy       bool
+	waiting    [PriorityHigh + 1][]chan struct{}
+	highStreak int
+}
+
+// acquire blocks until it's the caller's turn to write
+func (q *sendQueue) acquire(p Priority) {
+	if p < PriorityNormal || p > PriorityHigh {
+		p = PriorityNormal
+	}
+
+	q.lock.Lock()
+	if !q.busy {
+		q.busy = true
+		q.lock.Unlock()
+		return
+	}
+
+	turn := make(chan struct{})
+	q.waiting[p] = append(q.waiting[p], turn)
+	q.lock.Unlock()
+	<-turn
+}
+
+// tryAcquire takes the turn to write only if nobody has it
+func (q *sendQueue) tryAcquire() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.busy {
+		return false
+	}
+	q.busy = true
+	return true
+}
+
+// release hands the turn over to the next sender waiting
+func (q *sendQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	high, normal := q.waiting[PriorityHigh], q.waiting[PriorityNormal]
+
+	var next chan struct{}
+	switch {
+	case len(high) > 0 && (len(normal) == 0 || q.highStreak < maxHighStreak):
+		next, q.waiting[PriorityHigh] = high[0], high[1:]
+		q.highStreak++
+	case len(normal) > 0:
+		next, q.waiting[PriorityNormal] = normal[0], normal[1:]
+		q.highStreak = 0
+	default:
+		q.busy = false
+		q.highStreak = 0
+		return
+	}
+
+	close(next)
+}
+
+// SendPriority is Send for a message that should be written ahead of, or
+// along with, the others waiting. PriorityHigh messages jump ahead of
+// PriorityNormal ones, though not indefinitely: after a few high priority
+// messages in a row a normal one is let through.
+func (c *client) SendPriority(p Priority, message interface{}) error {
+	return c.send(websocket.BinaryMessage, sendOptions{priority: p}, message)
+}
@@ -0,0 +1,87 @@
+package kratos
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// test that waiting high priority senders go first, but not forever
+func TestSendQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		queue     sendQueue
+		orderLock sync.Mutex
+		order     []Priority
+		wg        sync.WaitGroup
+	)
+
+	queue.acquire(PriorityNormal)
+
+	waiting := func(p Priority) int {
+		queue.lock.Lock()
+		defer queue.lock.Unlock()
+		return len(queue.waiting[p])
+	}
+
+	enqueue := func(p Priority) {
+		before := waiting(p)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue.acquire(p)
+			orderLock.Lock()
+			order = append(order, p)
+			orderLock.Unlock()
+			queue.release()
+		}()
+
+		// wait for the sender to be in line so the order is known
+		for waiting(p) == before {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	enqueue(PriorityNormal)
+	for i := 0; i < maxHighStreak+2; i++ {
+		enqueue(PriorityHigh)
+	}
+
+	queue.release()
+	wg.Wait()
+
+	expected := make([]Priority, 0, maxHighStreak+3)
+	for i := 0; i < maxHighStreak; i++ {
+		expected = append(expected, PriorityHigh)
+	}
+	expected = append(expected, PriorityNormal, PriorityHigh, PriorityHigh)
+	assert.Equal(expected, order)
+}
+
+// test that TrySend doesn't wait for its turn
+func TestTrySend(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+	}
+
+	// another message is being written
+	testClient.sendQueue.acquire(PriorityNormal)
+	assert.Equal(ErrWouldBlock, testClient.TrySend(wrp.SimpleEvent{Destination: "event:test"}))
+
+	testClient.sendQueue.release()
+	assert.Nil(testClient.TrySend(wrp.SimpleEvent{Destination: "event:test"}))
+	fakeConn.AssertExpectations(t)
+}
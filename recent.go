@@ -0,0 +1,18 @@
+package kratos
+
+import "github.com/xmidt-org/wrp-go/wrp"
+
+// RecentMessages returns the last messages received, up to
+// RecentMessageBuffer of them, from the oldest to the most recent. It returns
+// nil when RecentMessageBuffer isn't set.
+func (c *client) RecentMessages() []wrp.Message {
+	if c.recent == nil {
+		return nil
+	}
+	items := c.recent.snapshot()
+	messages := make([]wrp.Message, len(items))
+	for i, item := range items {
+		messages[i] = item.(wrp.Message)
+	}
+	return messages
+}
@@ -0,0 +1,35 @@
+package kratos
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestRecentMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	destinations := func(messages []wrp.Message) (d []string) {
+		for _, msg := range messages {
+			d = append(d, msg.Destination)
+		}
+		return
+	}
+
+	testClient := &client{recent: newRing(3)}
+	assert.Empty(testClient.RecentMessages())
+
+	for i := 0; i < 2; i++ {
+		testClient.dispatch(wrp.Message{Destination: "/" + strconv.Itoa(i)}, nil)
+	}
+	assert.Equal([]string{"/0", "/1"}, destinations(testClient.RecentMessages()))
+
+	for i := 2; i < 7; i++ {
+		testClient.dispatch(wrp.Message{Destination: "/" + strconv.Itoa(i)}, nil)
+	}
+	assert.Equal([]string{"/4", "/5", "/6"}, destinations(testClient.RecentMessages()))
+
+	assert.Nil((&client{}).RecentMessages())
+}
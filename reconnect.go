@@ -0,0 +1,328 @@
+package kratos
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// ReconnectStrategy chooses where a reconnect goes. It's given the websocket
+// URL of the lost connection and returns the URL to dial directly, or an empty
+// string to go back through discovery at the DestinationURL, or one of the
+// DestinationEndpoints. Should dialing the returned URL fail, the following
+// attempts rediscover.
+type ReconnectStrategy func(lastURL string) string
+
+var (
+	// Rediscover asks petasos for a backend on every reconnect, which lets the
+	// load be rebalanced. It's the default.
+	Rediscover ReconnectStrategy = func(string) string { return "" }
+
+	// SameBackend dials the backend of the lost connection again, keeping the
+	// affinity and saving the round-trip to petasos.
+	SameBackend ReconnectStrategy = func(lastURL string) string { return lastURL }
+)
+
+const (
+	// Time to wait before reconnecting after a try again later (1013) close
+	// that didn't say when to come back.
+	tryAgainLaterWait = 30 * time.Second
+
+	// Bounds of the exponential backoff between failed reconnect attempts.
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 2 * time.Minute
+)
+
+// handleReadError looks at why conn stopped being readable, remembering the
+// close code and reason for LastCloseReason, and starts a reconnect when the
+// server's close code asked for one, or when conn failed without the server
+// closing it
+func (c *client) handleReadError(conn websocketConnection, err error) {
+	closeErr, ok := err.(*websocket.CloseError)
+	if ok {
+		c.lastClose.Store(closeErr)
+		logging.Info(c).Log(logging.MessageKey(), "Connection closed", "code", closeErr.Code, "reason", closeErr.Text)
+	}
+
+	if c.closing() {
+		// a close initiated by the user is never fought with a reconnect
+		return
+	}
+
+	// gorilla reports a connection dropped without a close frame as 1006
+	if !ok || closeErr.Code == websocket.CloseAbnormalClosure {
+		logging.Error(c).Log(logging.MessageKey(), "Read failed, reconnecting", logging.ErrorKey(), err)
+		c.reconnectFrom(conn, ReconnectReadError, err.Error(), 0)
+		return
+	}
+
+	var delay time.Duration
+	switch closeErr.Code {
+	case websocket.CloseServiceRestart:
+		// the backend is going away, reconnect right away and let discovery
+		// find the client a new home
+	case websocket.CloseTryAgainLater:
+		delay = parseRetryAfter(closeErr.Text)
+	default:
+		return
+	}
+
+	logging.Info(c).Log(logging.MessageKey(), "Server asked for a reconnect", "code", closeErr.Code,
+		"reason", closeErr.Text, "delay", delay)
+
+	if c.factory.OnReconnectDirective != nil {
+		c.factory.OnReconnectDirective(closeErr.Code, closeErr.Text, delay)
+	}
+
+	c.reconnectFrom(conn, ReconnectServerClose, strconv.Itoa(closeErr.Code), delay)
+}
+
+// startReconnect starts a reconnect in a goroutine unless one is running
+// already, since the connection it makes replaces the one lost for every
+// reason. The returned channel is closed once the reconnect running is over.
+func (c *client) startReconnect(reason ReconnectReason, detail string, delay time.Duration) <-chan struct{} {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+
+	if c.reconnecting != nil {
+		logging.Debug(c).Log(logging.MessageKey(), "Already reconnecting", "reason", reason, "detail", detail)
+		return c.reconnecting
+	}
+
+	done := make(chan struct{})
+	c.reconnecting = done
+	c.goroutine(func() {
+		defer func() {
+			c.reconnectLock.Lock()
+			c.reconnecting = nil
+			c.reconnectLock.Unlock()
+			close(done)
+		}()
+
+		c.redial(reason, detail, delay)
+	})
+
+	return done
+}
+
+// reconnectFrom starts a reconnect for the loss of conn, unless conn has
+// already been replaced or the client is closing, in which case the returned
+// channel is closed already
+func (c *client) reconnectFrom(conn websocketConnection, reason ReconnectReason, detail string, delay time.Duration) <-chan struct{} {
+	c.writeLock.Lock()
+	current := c.connection == conn
+	c.writeLock.Unlock()
+
+	if !current || c.closing() {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return c.startReconnect(reason, detail, delay)
+}
+
+// awaitReconnect starts a reconnect for the loss of conn, unless one is
+// running, and waits up to wait for it to be over, telling whether it was
+func (c *client) awaitReconnect(conn websocketConnection, reason ReconnectReason, detail string, wait time.Duration) bool {
+	done := c.reconnectFrom(conn, reason, detail, 0)
+
+	timer := c.clock().NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return !c.closing()
+	case <-timer.C():
+		return false
+	}
+}
+
+// shutdownContext returns a context canceled once the client is closed, which
+// cuts short a dial in progress
+func (c *client) shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// redial tears down the current connection and, after waiting delay, goes
+// back through discovery until a new connection is made or the client is
+// closed. Every attempt is recorded in the history along with the reason and
+// its detail. Only startReconnect calls it, so that there is a single one
+// running.
+func (c *client) redial(reason ReconnectReason, detail string, delay time.Duration) {
+	c.writeLock.Lock()
+	oldPingHandler := c.pingHandler
+	c.writeLock.Unlock()
+
+	if oldPingHandler != nil {
+		// the old connection, its read loop included, is done with before
+		// the new one is made
+		oldPingHandler.stopPingHandler()
+		<-oldPingHandler.done
+	}
+
+	// responses to what was sent on the old connection will never come
+	c.failTransactions()
+
+	// the idempotent requests kept for the new connection can't wait on one
+	// that won't come
+	reconnected := false
+	defer func() {
+		switch {
+		case reconnected:
+		case c.closing():
+			c.abandonTransactions(ErrClientClosed)
+		default:
+			c.abandonTransactions(ErrReconnected)
+		}
+	}()
+
+	if !c.factory.hasDiscovery() {
+		// the connection was handed over by NewWithConn and there is nowhere
+		// to go back to
+		logging.Error(c).Log(logging.MessageKey(), "Can't reconnect without a DestinationURL")
+		return
+	}
+
+	// the dials are made on the client's behalf, until it is closed
+	ctx, cancel := c.shutdownContext()
+	defer cancel()
+
+	strategy := c.factory.ReconnectStrategy
+	if strategy == nil {
+		strategy = Rediscover
+	}
+
+	lastURL := c.Hostname()
+	rediscover := false
+	prevSessionID, _ := c.sessionID.Load().(string)
+
+	// why the coming wait, for OnBackoff
+	why := string(reason)
+
+	backoff := minReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		if c.factory.OnBackoff != nil {
+			c.factory.OnBackoff(attempt, delay, why)
+		}
+
+		timer := c.clock().NewTimer(delay)
+		select {
+		case <-c.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		// both channels may have been ready, and select doesn't prefer shutdown
+		if c.closing() {
+			return
+		}
+
+		if cooldown := c.budget.take(c.factory.ReconnectBudget, c.clock().Now()); cooldown > 0 {
+			logging.Warn(c).Log(logging.MessageKey(), "Reconnect budget exhausted, cooling down",
+				"max", c.factory.ReconnectBudget.Max, "window", c.factory.ReconnectBudget.Window, "cooldown", cooldown)
+
+			if c.factory.OnReconnectBudgetExhausted != nil {
+				c.factory.OnReconnectBudgetExhausted(cooldown)
+			}
+
+			delay = cooldown
+			why = "reconnect budget exhausted"
+			continue
+		}
+
+		backendURL := ""
+		if !rediscover {
+			backendURL = strategy(lastURL)
+		}
+
+		var extra http.Header
+		if c.factory.OnReconnectDial != nil {
+			extra = make(http.Header)
+			c.factory.OnReconnectDial(prevSessionID, extra)
+		}
+
+		attempted := c.clock().Now()
+		err := c.connectTo(ctx, backendURL, extra)
+		if err == ErrClientClosed || (err != nil && c.closing()) {
+			return
+		}
+
+		if c.reconnects != nil {
+			c.reconnects.add(ReconnectEvent{
+				Time:      attempted,
+				Reason:    reason,
+				Detail:    detail,
+				Delay:     delay,
+				Succeeded: err == nil,
+				Err:       err,
+			})
+		}
+
+		if err != nil && backendURL != "" {
+			// the backend may be gone for good, let petasos pick the next one
+			rediscover = true
+		}
+
+		if err == nil {
+			reconnected = true
+			logging.Info(c).Log(logging.MessageKey(), "Reconnected", "hostname", c.Hostname())
+			c.markReconnected()
+			c.resendTransactions()
+			c.resendSticky()
+			return
+		}
+
+		logging.Error(c).Log(logging.MessageKey(), "Failed to reconnect", logging.ErrorKey(), err)
+
+		delay = backoff
+		why = "previous attempt failed: " + err.Error()
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// jitterAge shortens a maximum connection age by up to a tenth at random so
+// clients that connected together don't all reconnect at the same time
+func jitterAge(age time.Duration) time.Duration {
+	if spread := int64(age / 10); spread > 0 {
+		return age - time.Duration(rand.Int63n(spread))
+	}
+	return age
+}
+
+// parseRetryAfter reads the delay out of a try again later close reason. The
+// reason may hold a number of seconds or a duration, optionally prefixed by
+// "Retry-After:" or "retry-after=", the same way the HTTP header is written.
+func parseRetryAfter(reason string) time.Duration {
+	value := strings.TrimSpace(reason)
+	if strings.HasPrefix(strings.ToLower(value), "retry-after") {
+		value = strings.TrimSpace(value[len("retry-after"):])
+		value = strings.TrimSpace(strings.TrimLeft(value, ":="))
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d
+	}
+
+	return tryAgainLaterWait
+}
@@ -0,0 +1,516 @@
+package kratos
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		reason   string
+		expected time.Duration
+	}{
+		{"", tryAgainLaterWait},
+		{"overloaded", tryAgainLaterWait},
+		{"45", 45 * time.Second},
+		{"1m30s", 90 * time.Second},
+		{"Retry-After: 10", 10 * time.Second},
+		{"retry-after=2m", 2 * time.Minute},
+		{"-5", tryAgainLaterWait},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.reason, func(t *testing.T) {
+			assert.New(t).Equal(tc.expected, parseRetryAfter(tc.reason))
+		})
+	}
+}
+
+func TestJitterAge(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 100; i++ {
+		age := jitterAge(time.Hour)
+		assert.True(age <= time.Hour)
+		assert.True(age > 54*time.Minute)
+	}
+
+	assert.Equal(time.Nanosecond, jitterAge(time.Nanosecond))
+}
+
+func TestHandleReadErrorDirective(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		called      bool
+		delay       time.Duration
+	}{
+		{"service restart", &websocket.CloseError{Code: websocket.CloseServiceRestart}, true, 0},
+		{"try again later", &websocket.CloseError{Code: websocket.CloseTryAgainLater, Text: "5"}, true, 5 * time.Second},
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false, 0},
+		{"transport error", errors.New("connection reset by peer"), false, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			called := false
+			var delay time.Duration
+
+			testClient := &client{
+				Logger:   logging.New(nil),
+				shutdown: make(chan struct{}),
+				factory: ClientFactory{
+					OnReconnectDirective: func(code int, reason string, d time.Duration) {
+						called = true
+						delay = d
+					},
+				},
+			}
+
+			// without a DestinationURL the reconnect gives up right away
+			testClient.handleReadError(nil, tc.err)
+
+			assert.Equal(tc.called, called)
+			assert.Equal(tc.delay, delay)
+
+			code, reason := testClient.LastCloseReason()
+			if closeErr, ok := tc.err.(*websocket.CloseError); ok {
+				assert.Equal(closeErr.Code, code)
+				assert.Equal(closeErr.Text, reason)
+			} else {
+				assert.Zero(code)
+				assert.Empty(reason)
+			}
+		})
+	}
+}
+
+// test that a read failing without the server closing the connection
+// reconnects, while a close without a reconnect directive doesn't
+func TestHandleReadErrorReconnects(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		reason      ReconnectReason
+	}{
+		{"transport error", errors.New("connection reset by peer"), ReconnectReadError},
+		{"dropped", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, ReconnectReadError},
+		{"service restart", &websocket.CloseError{Code: websocket.CloseServiceRestart}, ReconnectServerClose},
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reasons := make(chan string, 10)
+			testClient := &client{
+				Logger:     logging.New(nil),
+				shutdown:   make(chan struct{}),
+				headerInfo: &clientHeader{deviceName: "mac:ffffff112233"},
+				factory: ClientFactory{
+					DestinationURL: "http://fabric.example.com/api/v2/device",
+					NetDial: func(network, addr string) (net.Conn, error) {
+						return nil, errors.New("unreachable")
+					},
+					OnBackoff: func(attempt int, delay time.Duration, why string) {
+						if attempt == 1 {
+							reasons <- why
+						}
+					},
+				},
+			}
+
+			testClient.handleReadError(nil, tc.err)
+			if tc.reason == "" {
+				select {
+				case why := <-reasons:
+					assert.Fail("reconnected", why)
+				case <-time.After(50 * time.Millisecond):
+				}
+			} else {
+				select {
+				case why := <-reasons:
+					assert.Equal(string(tc.reason), why)
+				case <-time.After(3 * time.Second):
+					assert.Fail("no reconnect")
+				}
+			}
+
+			assert.Nil(testClient.Close())
+		})
+	}
+}
+
+// test that closing the client as the read loop fails never leads to a
+// reconnect, and that nothing is left running afterwards
+func TestCloseDuringReadError(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		testClient  *client
+		dialLock    sync.Mutex
+		closedDials int
+	)
+
+	stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	close(stoppedPingHandler.done)
+
+	testClient = &client{
+		Logger:      logging.New(nil),
+		shutdown:    make(chan struct{}),
+		pingHandler: stoppedPingHandler,
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				// the dial itself tells whether the client was closed by then
+				dialLock.Lock()
+				if testClient.closing() {
+					closedDials++
+				}
+				dialLock.Unlock()
+				return nil, errors.New("unreachable")
+			},
+		},
+	}
+
+	start := make(chan struct{})
+	readFailed := make(chan struct{})
+	go func() {
+		<-start
+		testClient.handleReadError(nil, &websocket.CloseError{Code: websocket.CloseServiceRestart})
+		close(readFailed)
+	}()
+
+	close(start)
+	assert.Nil(testClient.Close())
+	<-readFailed
+
+	deadline := time.Now().Add(3 * time.Second)
+	for testClient.GoroutineCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Zero(testClient.GoroutineCount())
+
+	// a dial may have been under way as the client closed, but the client
+	// doesn't dial again after it
+	dialLock.Lock()
+	assert.True(closedDials <= 1)
+	dialLock.Unlock()
+}
+
+func TestReconnectStrategy(t *testing.T) {
+	tests := []struct {
+		description string
+		strategy    ReconnectStrategy
+		dials       []string
+	}{
+		{"default", nil, []string{"fabric.example.com:80"}},
+		{"rediscover", Rediscover, []string{"fabric.example.com:80"}},
+		{"same backend", SameBackend, []string{"talaria-1.example.com:8080", "fabric.example.com:80"}},
+		{"custom", func(string) string { return "ws://talaria-2.example.com:8080/api/v2/device" }, []string{"talaria-2.example.com:8080"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			dials := make(chan string, 10)
+			stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+			close(stoppedPingHandler.done)
+
+			testClient := &client{
+				Logger:      logging.New(nil),
+				shutdown:    make(chan struct{}),
+				pingHandler: stoppedPingHandler,
+				headerInfo:  &clientHeader{deviceName: "mac:ffffff112233"},
+				factory: ClientFactory{
+					DestinationURL:    "http://fabric.example.com/api/v2/device",
+					ReconnectStrategy: tc.strategy,
+					NetDial: func(network, addr string) (net.Conn, error) {
+						dials <- addr
+						return nil, errors.New("unreachable")
+					},
+				},
+			}
+			testClient.hostname.Store("ws://talaria-1.example.com:8080/api/v2/device")
+
+			testClient.startReconnect(ReconnectServerClose, "1012", 0)
+			for _, expected := range tc.dials {
+				select {
+				case addr := <-dials:
+					assert.Equal(expected, addr)
+				case <-time.After(3 * time.Second):
+					assert.Fail("no dial to " + expected)
+				}
+			}
+
+			assert.Nil(testClient.Close())
+		})
+	}
+}
+
+// test that OnReconnectDial gets the session id of the previous handshake and
+// its headers only go to the handshakes of reconnects
+func TestOnReconnectDial(t *testing.T) {
+	assert := assert.New(t)
+
+	lastSessionIDs := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastSessionIDs <- r.Header.Get("Last-Session-Id")
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Session-Id": {"session-1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer backend.Close()
+
+	factory := &ClientFactory{
+		DeviceName:        "mac:ffffff112233",
+		DestinationURL:    "http://unused.example.com",
+		ClientLogger:      logging.New(nil),
+		ReconnectStrategy: SameBackend,
+		SessionIDHeader:   "X-Session-Id",
+		OnReconnectDial: func(prevSessionID string, headers http.Header) {
+			headers.Set("Last-Session-Id", prevSessionID)
+		},
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+
+	assert.Nil(testClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil))
+	assert.Empty(<-lastSessionIDs)
+
+	testClient.startReconnect(ReconnectServerClose, "1012", 0)
+	select {
+	case lastSessionID := <-lastSessionIDs:
+		assert.Equal("session-1", lastSessionID)
+	case <-time.After(3 * time.Second):
+		assert.Fail("no reconnect")
+	}
+
+	assert.Nil(testClient.Close())
+}
+
+func TestReconnectHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	dialed := make(chan struct{}, 10)
+	stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	close(stoppedPingHandler.done)
+
+	testClient := &client{
+		Logger:      logging.New(nil),
+		shutdown:    make(chan struct{}),
+		pingHandler: stoppedPingHandler,
+		headerInfo:  &clientHeader{deviceName: "mac:ffffff112233"},
+		reconnects:  newRing(1),
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				dialed <- struct{}{}
+				return nil, errors.New("unreachable")
+			},
+		},
+	}
+
+	assert.Empty(testClient.ReconnectHistory())
+	testClient.startReconnect(ReconnectServerClose, "1013", 5*time.Millisecond)
+
+	// the second attempt waits out the backoff, leaving time to look at the first
+	<-dialed
+	var history []ReconnectEvent
+	for deadline := time.Now().Add(time.Second); len(history) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		history = testClient.ReconnectHistory()
+	}
+
+	if assert.Len(history, 1) {
+		assert.Equal(ReconnectServerClose, history[0].Reason)
+		assert.Equal("1013", history[0].Detail)
+		assert.Equal(5*time.Millisecond, history[0].Delay)
+		assert.False(history[0].Succeeded)
+		assert.NotNil(history[0].Err)
+	}
+
+	// the history keeps only the most recent attempt
+	<-dialed
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if history = testClient.ReconnectHistory(); len(history) == 1 && history[0].Delay == minReconnectBackoff {
+			break
+		}
+	}
+	assert.Len(history, 1)
+	assert.Equal(minReconnectBackoff, history[0].Delay)
+
+	assert.Nil(testClient.Close())
+	assert.Nil((&client{}).ReconnectHistory())
+}
+
+type backoff struct {
+	attempt int
+	delay   time.Duration
+	reason  string
+}
+
+// test that every wait of the reconnect loop is reported before it starts
+func TestOnBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	backoffs := make(chan backoff, 10)
+	stoppedPingHandler := &pingHandler{stop: make(chan bool), done: make(chan struct{})}
+	close(stoppedPingHandler.done)
+
+	testClient := &client{
+		Logger:      logging.New(nil),
+		shutdown:    make(chan struct{}),
+		pingHandler: stoppedPingHandler,
+		headerInfo:  &clientHeader{deviceName: "mac:ffffff112233"},
+		factory: ClientFactory{
+			DestinationURL: "http://fabric.example.com/api/v2/device",
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return nil, errors.New("unreachable")
+			},
+			OnBackoff: func(attempt int, delay time.Duration, reason string) {
+				backoffs <- backoff{attempt, delay, reason}
+			},
+		},
+	}
+
+	testClient.startReconnect(ReconnectServerClose, "1013", 5*time.Millisecond)
+
+	assert.Equal(backoff{1, 5 * time.Millisecond, "server-close"}, <-backoffs)
+
+	second := <-backoffs
+	assert.Equal(2, second.attempt)
+	assert.Equal(minReconnectBackoff, second.delay)
+	assert.Contains(second.reason, "unreachable")
+
+	assert.Nil(testClient.Close())
+}
+
+// test that reconnects asked for while one is running don't dial again, and
+// that the old connection is done with before the new one is made
+func TestReconnectSingleFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	var upgrades int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&upgrades, 1)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	factory := &ClientFactory{
+		DeviceName:        "mac:ffffff112233",
+		DestinationURL:    "http://unused.example.com",
+		ClientLogger:      logging.New(nil),
+		ReconnectStrategy: SameBackend,
+	}
+
+	testClient, err := factory.newClient()
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Nil(testClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil))
+
+	testClient.writeLock.Lock()
+	oldPingHandler := testClient.pingHandler
+	testClient.writeLock.Unlock()
+
+	first := testClient.startReconnect(ReconnectServerClose, "1012", 10*time.Millisecond)
+	second := testClient.startReconnect(ReconnectMaxAge, "", 0)
+	assert.Equal(first, second)
+
+	select {
+	case <-first:
+	case <-time.After(3 * time.Second):
+		assert.Fail("no reconnect")
+	}
+
+	select {
+	case <-oldPingHandler.done:
+	default:
+		assert.Fail("the old connection is still running")
+	}
+
+	assert.Equal(int32(2), atomic.LoadInt32(&upgrades))
+	assert.Nil(testClient.Close())
+}
+
+// test that closing the client cuts short a reconnect stuck dialing
+func TestReconnectDialClosed(t *testing.T) {
+	assert := assert.New(t)
+
+	// accepts connections and never answers on them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(err) {
+		return
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: "http://" + listener.Addr().String(),
+		ClientLogger:   logging.New(nil),
+	}
+
+	testClient, err := factory.newClient()
+	if !assert.Nil(err) {
+		return
+	}
+
+	done := testClient.startReconnect(ReconnectServerClose, "1012", 0)
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(3 * time.Second):
+		assert.Fail("no dial")
+		return
+	}
+
+	assert.Nil(testClient.Close())
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		assert.Fail("the reconnect kept dialing after the client was closed")
+	}
+}
@@ -0,0 +1,39 @@
+package kratos
+
+import "sync"
+
+// ring keeps the last items added, overwriting the oldest once it is full
+type ring struct {
+	lock  sync.Mutex
+	items []interface{}
+	next  int
+	full  bool
+}
+
+func newRing(size int) *ring {
+	return &ring{items: make([]interface{}, size)}
+}
+
+func (r *ring) add(item interface{}) {
+	r.lock.Lock()
+	r.items[r.next] = item
+	if r.next++; r.next == len(r.items) {
+		r.next = 0
+		r.full = true
+	}
+	r.lock.Unlock()
+}
+
+// snapshot returns the items from the oldest to the most recent
+func (r *ring) snapshot() []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.full {
+		return append([]interface{}(nil), r.items[:r.next]...)
+	}
+
+	snapshot := make([]interface{}, 0, len(r.items))
+	snapshot = append(snapshot, r.items[r.next:]...)
+	return append(snapshot, r.items[:r.next]...)
+}
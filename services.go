@@ -0,0 +1,13 @@
+package kratos
+
+// unhandledServices returns the advertised Services whose messages, addressed
+// to the device, no handler would be given
+func (c *client) unhandledServices() []string {
+	var unhandled []string
+	for _, service := range c.factory.Services {
+		if len(c.WouldMatch(c.deviceID+"/"+service)) == 0 {
+			unhandled = append(unhandled, service)
+		}
+	}
+	return unhandled
+}
@@ -0,0 +1,33 @@
+package kratos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+func TestServices(t *testing.T) {
+	assert := assert.New(t)
+
+	factory := &ClientFactory{
+		DeviceName: "mac:ffffff112233",
+		Handlers: []HandlerRegistry{
+			{HandlerKey: "/config", Handler: &myReadHandler{}},
+			{HandlerKey: "/hw/.*", Handler: &myReadHandler{}},
+		},
+		Services:     []string{"config", "logging", "hw"},
+		ClientLogger: logging.New(nil),
+	}
+
+	testClient, err := factory.newClient()
+	assert.Nil(err)
+	assert.Equal([]string{"logging", "hw"}, testClient.unhandledServices())
+	assert.Equal("config,logging,hw", deviceHeaders(testClient.headerInfo).Get("X-Webpa-Services"))
+
+	// everything is handled by a default handler
+	factory.DefaultHandler = &myReadHandler{}
+	testClient, err = factory.newClient()
+	assert.Nil(err)
+	assert.Empty(testClient.unhandledServices())
+}
@@ -0,0 +1,52 @@
+package kratos
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBufferFull is returned by Send when writing the message would take the
+// data waiting to be written over ClientFactory.MaxBufferedBytes
+var ErrBufferFull = errors.New("too many bytes waiting to be written")
+
+// Stats is a snapshot of what a client is holding on to
+type Stats struct {
+	// BufferedBytes is the size of the encoded messages waiting to be written.
+	BufferedBytes int64
+
+	// QueueDepth is the number of messages waiting to be written.
+	QueueDepth int
+
+	// InflightRequests is the number of SendWithResponse calls waiting on a response.
+	InflightRequests int
+
+	// UnprocessedInbound is the number of messages read ahead of the
+	// handlers, with ReadBatchSize or while dispatch is paused.
+	UnprocessedInbound int
+}
+
+// Stats returns a snapshot of what the client is holding on to
+func (c *client) Stats() Stats {
+	return Stats{
+		BufferedBytes:      atomic.LoadInt64(&c.bufferedBytes),
+		QueueDepth:         c.QueueDepth(),
+		InflightRequests:   c.InflightRequests(),
+		UnprocessedInbound: int(atomic.LoadInt32(&c.unprocessed)),
+	}
+}
+
+// reserveBuffer accounts for size more bytes waiting to be written, unless it
+// would go over MaxBufferedBytes. A message is always let through when nothing
+// else is waiting so that one bigger than the limit can still be sent.
+func (c *client) reserveBuffer(size int64) error {
+	buffered := atomic.AddInt64(&c.bufferedBytes, size)
+	if max := c.factory.MaxBufferedBytes; max > 0 && buffered > max && buffered != size {
+		atomic.AddInt64(&c.bufferedBytes, -size)
+		return ErrBufferFull
+	}
+	return nil
+}
+
+func (c *client) releaseBuffer(size int64) {
+	atomic.AddInt64(&c.bufferedBytes, -size)
+}
@@ -0,0 +1,61 @@
+package kratos
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// test that a write stalled on the connection counts against MaxBufferedBytes
+func TestMaxBufferedBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	writing := make(chan struct{})
+	unblock := make(chan struct{})
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once().Run(func(mock.Arguments) {
+		close(writing)
+		<-unblock
+	})
+
+	testClient := &client{
+		connection:   fakeConn,
+		Logger:       logging.New(nil),
+		transactions: make(map[string]*transaction),
+		factory:      ClientFactory{MaxBufferedBytes: 64},
+	}
+
+	sent := make(chan error)
+	go func() {
+		// bigger than the limit, but nothing else is waiting
+		sent <- testClient.Send(wrp.SimpleEvent{Destination: "event:test", Payload: make([]byte, 100)})
+	}()
+
+	<-writing
+	stats := testClient.Stats()
+	assert.True(stats.BufferedBytes > 100)
+	assert.Equal(1, stats.QueueDepth)
+
+	assert.Equal(ErrBufferFull, testClient.Send(wrp.SimpleEvent{Destination: "event:test"}))
+
+	close(unblock)
+	assert.Nil(<-sent)
+	assert.Equal(Stats{}, testClient.Stats())
+	fakeConn.AssertExpectations(t)
+}
+
+// test that the messages held while dispatch is paused are counted
+func TestStatsUnprocessedInbound(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := &client{Logger: logging.New(nil)}
+	testClient.PauseDispatch()
+
+	assert.True(testClient.hold(websocket.BinaryMessage, []byte("held")))
+	assert.Equal(1, testClient.Stats().UnprocessedInbound)
+}
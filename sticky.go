@@ -0,0 +1,37 @@
+package kratos
+
+import (
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// SendSticky sends message now and remembers it as the state of destination,
+// sending it again after every reconnect so the server is always told the
+// latest state. Only the last message sent sticky to a destination is kept,
+// and it is remembered even when sending it now fails.
+func (c *client) SendSticky(destination string, message interface{}) error {
+	c.stickyLock.Lock()
+	if c.sticky == nil {
+		c.sticky = make(map[string]interface{})
+	}
+	c.sticky[destination] = message
+	c.stickyLock.Unlock()
+
+	return c.Send(message)
+}
+
+// resendSticky sends the sticky messages again on a new connection
+func (c *client) resendSticky() {
+	c.stickyLock.Lock()
+	messages := make(map[string]interface{}, len(c.sticky))
+	for destination, message := range c.sticky {
+		messages[destination] = message
+	}
+	c.stickyLock.Unlock()
+
+	for destination, message := range messages {
+		if err := c.Send(message); err != nil {
+			logging.Error(c).Log(logging.MessageKey(), "Failed to resend sticky message",
+				"destination", destination, logging.ErrorKey(), err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package kratos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// test that only the last sticky message of each destination is sent again
+func TestSendSticky(t *testing.T) {
+	assert := assert.New(t)
+
+	sent := make(chan []byte, 10)
+	testClient := &client{
+		connection: &channelConnection{written: sent},
+		Logger:     logging.New(nil),
+	}
+
+	maintenance := "event:device-status/mac:ffffff112233/maintenance"
+	assert.Nil(testClient.SendSticky(maintenance, wrp.SimpleEvent{Destination: maintenance, Payload: []byte("on")}))
+	assert.Nil(testClient.SendSticky(maintenance, wrp.SimpleEvent{Destination: maintenance, Payload: []byte("off")}))
+	assert.Len(sent, 2)
+	<-sent
+	<-sent
+
+	testClient.resendSticky()
+	assert.Len(sent, 1)
+
+	var event wrp.Message
+	assert.Nil(wrp.NewDecoderBytes(<-sent, wrp.Msgpack).Decode(&event))
+	assert.Equal([]byte("off"), event.Payload)
+}
@@ -0,0 +1,101 @@
+package kratos
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// The metadata of the messages sent by SendStream, letting the server put the
+// payload back together.
+const (
+	// StreamIDKey is the id shared by all the chunks of a stream.
+	StreamIDKey = "stream-id"
+
+	// StreamChunkKey is the index of the chunk in the stream, from 0.
+	StreamChunkKey = "stream-chunk"
+
+	// StreamLastKey is "true" on the last chunk and "false" on the others.
+	StreamLastKey = "stream-last"
+
+	// StreamChunksKey is the total number of chunks, set on the last one only
+	// since it isn't known before the whole stream is read.
+	StreamChunksKey = "stream-chunks"
+)
+
+// ErrInvalidChunkSize is returned by SendStream for a chunk size that isn't
+// positive
+var ErrInvalidChunkSize = errors.New("chunk size must be positive")
+
+// SendStream sends everything read from r to destination, as a series of
+// events of up to chunkSize bytes each, in order. Only two chunks are held in
+// memory at a time. The chunks are tied together and numbered by their
+// metadata, see StreamIDKey and the related keys. An empty r is sent as a
+// single empty chunk.
+func (c *client) SendStream(destination string, r io.Reader, chunkSize int) error {
+	return c.sendStream(c.Send, destination, "application/octet-stream", r, chunkSize)
+}
+
+// sendStream is SendStream sending each chunk with send and contentType
+func (c *client) sendStream(send func(message interface{}) error, destination, contentType string, r io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		return ErrInvalidChunkSize
+	}
+
+	streamID := newTransactionUUID()
+
+	// the chunk after the one being sent is read ahead of time to tell
+	// whether the current one is the last
+	current, next := make([]byte, chunkSize), make([]byte, chunkSize)
+	n, err := readChunk(r, current)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; ; index++ {
+		var nextN int
+		last := n < chunkSize
+		if !last {
+			if nextN, err = readChunk(r, next); err != nil {
+				return err
+			}
+			last = nextN == 0
+		}
+
+		metadata := map[string]string{
+			StreamIDKey:    streamID,
+			StreamChunkKey: strconv.Itoa(index),
+			StreamLastKey:  strconv.FormatBool(last),
+		}
+		if last {
+			metadata[StreamChunksKey] = strconv.Itoa(index + 1)
+		}
+
+		// Send is done with the payload once it returns, so the buffer can
+		// be read into again
+		err = send(wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			Source:      c.deviceID,
+			Destination: destination,
+			ContentType: contentType,
+			Metadata:    metadata,
+			Payload:     current[:n],
+		})
+		if err != nil || last {
+			return err
+		}
+
+		current, next, n = next, current, nextN
+	}
+}
+
+// readChunk fills chunk as much as r allows, the end of r isn't an error
+func readChunk(r io.Reader, chunk []byte) (int, error) {
+	n, err := io.ReadFull(r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
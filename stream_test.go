@@ -0,0 +1,75 @@
+package kratos
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestSendStream(t *testing.T) {
+	tests := []struct {
+		description string
+		data        string
+		payloads    []string
+	}{
+		{"partial last chunk", "0123456789", []string{"0123", "4567", "89"}},
+		{"full last chunk", "01234567", []string{"0123", "4567"}},
+		{"empty", "", []string{""}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var sent []wrp.Message
+			fakeConn := &mockConnection{}
+			fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Run(func(args mock.Arguments) {
+				var msg wrp.Message
+				assert.Nil(wrp.NewDecoderBytes(args.Get(1).([]byte), wrp.Msgpack).Decode(&msg))
+				sent = append(sent, msg)
+			})
+
+			testClient := &client{
+				deviceID:   "mac:ffffff112233",
+				connection: fakeConn,
+				Logger:     logging.New(nil),
+			}
+
+			assert.Nil(testClient.SendStream("event:upload/logs", strings.NewReader(tc.data), 4))
+
+			if !assert.Len(sent, len(tc.payloads)) {
+				return
+			}
+
+			streamID := sent[0].Metadata[StreamIDKey]
+			assert.NotEmpty(streamID)
+
+			var reassembled bytes.Buffer
+			for i, msg := range sent {
+				last := i == len(sent)-1
+				assert.Equal("event:upload/logs", msg.Destination)
+				assert.Equal(streamID, msg.Metadata[StreamIDKey])
+				assert.Equal(strconv.Itoa(i), msg.Metadata[StreamChunkKey])
+				assert.Equal(strconv.FormatBool(last), msg.Metadata[StreamLastKey])
+				if last {
+					assert.Equal(strconv.Itoa(len(sent)), msg.Metadata[StreamChunksKey])
+				} else {
+					assert.NotContains(msg.Metadata, StreamChunksKey)
+				}
+				assert.Equal(tc.payloads[i], string(msg.Payload))
+				reassembled.Write(msg.Payload)
+			}
+
+			assert.Equal(tc.data, reassembled.String())
+		})
+	}
+
+	assert.New(t).Equal(ErrInvalidChunkSize, (&client{}).SendStream("event:upload/logs", strings.NewReader("data"), 0))
+}
@@ -0,0 +1,124 @@
+package kratos
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrConnectionAdopted is returned by NewWithConnection for an exported
+// connection that was already adopted, or dropped
+var ErrConnectionAdopted = errors.New("exported connection already adopted")
+
+// ExportedConnection is an open connection taken out of a client by
+// ExportConnection, waiting to be adopted by a new client with
+// NewWithConnection. The messages arriving in between wait for the new
+// client's handlers.
+type ExportedConnection struct {
+	conn     *websocket.Conn
+	url      string
+	readDone <-chan struct{}
+
+	// closed once the connection is adopted by next, or dropped
+	adopted chan struct{}
+	next    *client
+	once    sync.Once
+}
+
+// Close drops an exported connection that won't be adopted after all
+func (e *ExportedConnection) Close() (err error) {
+	err = ErrConnectionAdopted
+	e.once.Do(func() {
+		err = e.conn.Close()
+		close(e.adopted)
+	})
+	return
+}
+
+// ExportConnection hands the connection over for another client to take it
+// with NewWithConnection, without the server seeing it go. The client stops as
+// if it were closed, failing its pending SendWithResponse calls with
+// ErrReconnected, but the connection stays open.
+func (c *client) ExportConnection() (*ExportedConnection, error) {
+	c.writeLock.Lock()
+	if c.closing() {
+		c.writeLock.Unlock()
+		return nil, ErrClientClosed
+	}
+
+	conn, ok := c.connection.(*websocket.Conn)
+	pingHandler := c.pingHandler
+	if !ok || conn == nil || pingHandler == nil {
+		c.writeLock.Unlock()
+		return nil, ErrNotConnected
+	}
+
+	exported := &ExportedConnection{
+		conn:     conn,
+		url:      c.Hostname(),
+		readDone: pingHandler.readDone,
+		adopted:  make(chan struct{}),
+	}
+
+	// from now on the read loop holds the messages for the next client
+	c.handover.Store(exported)
+	c.connection = nil
+	c.pingHandler = nil
+	c.writeLock.Unlock()
+
+	c.shutdownOnce.Do(func() { close(c.shutdown) })
+	pingHandler.releasePingHandler()
+	<-pingHandler.done
+
+	c.markConnected(false)
+	c.failTransactions()
+	return exported, nil
+}
+
+// owner is the client the messages read off the connection belong to, which
+// changes when the connection is exported. It waits for an exported connection
+// to be adopted, and is nil once it was dropped instead.
+func (c *client) owner() *client {
+	for c != nil {
+		exported, _ := c.handover.Load().(*ExportedConnection)
+		if exported == nil {
+			return c
+		}
+
+		<-exported.adopted
+		c = exported.next
+	}
+	return nil
+}
+
+// NewWithConnection creates a client running over a connection exported by
+// another one, which the server keeps seeing as the same session. Only the
+// ReadBatchSize of the previous client carries over, everything else is
+// configured by the factory. OnConnect isn't called since the connection is
+// not new, but once it is lost the client reconnects as any other would.
+func (f *ClientFactory) NewWithConnection(exported *ExportedConnection) (Client, error) {
+	newClient, err := f.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrConnectionAdopted
+	exported.once.Do(func() {
+		// the read loop waits on adopted until next is set
+		_, err = newClient.install(exported.conn, exported.url, exported.readDone)
+		if err == nil {
+			exported.next = newClient
+		} else {
+			exported.conn.Close()
+		}
+		close(exported.adopted)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	newClient.startHeartbeat()
+	return newClient, nil
+}
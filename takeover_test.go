@@ -0,0 +1,85 @@
+package kratos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+type channelHandler chan interface{}
+
+func (c channelHandler) HandleMessage(msg interface{}) {
+	c <- msg
+}
+
+// test that messages reach the client that adopted an exported connection
+// while the server keeps the same one
+func TestExportConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	var upgrades int32
+	send := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&upgrades, 1)
+
+		<-send
+		conn.WriteMessage(websocket.BinaryMessage, goodMsg)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	oldHandler, newHandler := make(channelHandler, 1), make(channelHandler, 1)
+	factory := &ClientFactory{
+		DeviceName:     "mac:ffffff112233",
+		DestinationURL: "http://unused.example.com",
+		ClientLogger:   logging.New(nil),
+		Handlers:       []HandlerRegistry{{HandlerKey: "/bar", Handler: oldHandler}},
+	}
+
+	oldClient, err := factory.newClient()
+	assert.Nil(err)
+	assert.Nil(oldClient.connectTo(context.Background(), strings.Replace(backend.URL, "http", "ws", 1), nil))
+
+	exported, err := oldClient.ExportConnection()
+	assert.Nil(err)
+	assert.Equal(ErrNotConnected, oldClient.Send(goodMsg))
+
+	_, err = oldClient.ExportConnection()
+	assert.Equal(ErrClientClosed, err)
+
+	// the message sent in between waits for the new client
+	close(send)
+
+	factory.Handlers = []HandlerRegistry{{HandlerKey: "/bar", Handler: newHandler}}
+	newClient, err := factory.NewWithConnection(exported)
+	assert.Nil(err)
+	defer newClient.Close()
+
+	select {
+	case <-newHandler:
+	case <-time.After(time.Second):
+		assert.Fail("the new client didn't get the message")
+	}
+	assert.Len(oldHandler, 0)
+	assert.Equal(int32(1), atomic.LoadInt32(&upgrades))
+
+	_, err = factory.NewWithConnection(exported)
+	assert.Equal(ErrConnectionAdopted, err)
+}
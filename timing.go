@@ -0,0 +1,43 @@
+package kratos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInconsistentTiming is returned by New when timeouts and periods of the
+// ClientFactory contradict each other
+var ErrInconsistentTiming = errors.New("inconsistent timing configuration")
+
+// validateTiming checks the timing settings against each other and reports
+// every inconsistency found at once
+func (f *ClientFactory) validateTiming() error {
+	var problems []string
+
+	readDeadline, pingPeriod := f.readDeadline(), f.pingPeriod()
+	if readDeadline > 0 && readDeadline <= pingPeriod {
+		problems = append(problems, fmt.Sprintf("the read deadline %s must be longer than the ping period %s since pongs push it back", readDeadline, pingPeriod))
+	}
+
+	if f.HandlerHardTimeout > 0 && readDeadline > 0 && f.HandlerHardTimeout >= readDeadline {
+		problems = append(problems, fmt.Sprintf("HandlerHardTimeout %s must be shorter than the read deadline %s, which a handler blocking the read loop makes expire first", f.HandlerHardTimeout, readDeadline))
+	}
+
+	if maxPongAge := f.HealthThresholds.MaxPongAge; maxPongAge > 0 && maxPongAge <= pingPeriod {
+		problems = append(problems, fmt.Sprintf("HealthThresholds.MaxPongAge %s must be longer than the ping period %s", maxPongAge, pingPeriod))
+	}
+
+	if budget := f.ReconnectBudget; budget.Max > 0 && budget.Window <= 0 {
+		problems = append(problems, fmt.Sprintf("ReconnectBudget.Window %s must be positive", budget.Window))
+	}
+
+	if heartbeat := f.HeartbeatEvent; heartbeat != nil && heartbeat.Interval <= 0 {
+		problems = append(problems, fmt.Sprintf("HeartbeatEvent.Interval %s must be positive", heartbeat.Interval))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInconsistentTiming, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package kratos
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTiming(t *testing.T) {
+	tests := []struct {
+		description string
+		factory     ClientFactory
+		problems    []string
+	}{
+		{"defaults", ClientFactory{}, nil},
+		{"no read deadline", ClientFactory{ReadDeadline: -1, HandlerHardTimeout: time.Hour}, nil},
+		{"short read deadline", ClientFactory{ReadDeadline: time.Minute}, nil},
+		{"short read deadline and ping", ClientFactory{ReadDeadline: time.Minute, PingPeriod: 50 * time.Second, HealthThresholds: HealthThresholds{MaxPongAge: time.Minute}}, nil},
+		{"read deadline before ping", ClientFactory{ReadDeadline: time.Minute, PingPeriod: 2 * time.Minute}, []string{"read deadline"}},
+		{"handler timeout after read deadline", ClientFactory{HandlerHardTimeout: pongWait}, []string{"HandlerHardTimeout"}},
+		{"pong age before ping", ClientFactory{HealthThresholds: HealthThresholds{MaxPongAge: time.Minute}}, []string{"MaxPongAge"}},
+		{"pong age before ping of the read deadline", ClientFactory{ReadDeadline: 2 * time.Minute, HealthThresholds: HealthThresholds{MaxPongAge: time.Minute}}, []string{"MaxPongAge"}},
+		{"budget without window", ClientFactory{ReconnectBudget: ReconnectBudget{Max: 3}}, []string{"ReconnectBudget.Window"}},
+		{"heartbeat without interval", ClientFactory{HeartbeatEvent: &HeartbeatEvent{}}, []string{"HeartbeatEvent.Interval"}},
+		{
+			"all at once",
+			ClientFactory{
+				ReadDeadline:       time.Minute,
+				PingPeriod:         2 * time.Minute,
+				HandlerHardTimeout: time.Hour,
+				ReconnectBudget:    ReconnectBudget{Max: 3, Window: -time.Minute},
+			},
+			[]string{"read deadline", "HandlerHardTimeout", "ReconnectBudget.Window"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := tc.factory.validateTiming()
+			if len(tc.problems) == 0 {
+				assert.Nil(err)
+				return
+			}
+
+			if assert.True(errors.Is(err, ErrInconsistentTiming)) {
+				assert.Len(strings.Split(err.Error(), "; "), len(tc.problems))
+				for _, problem := range tc.problems {
+					assert.Contains(err.Error(), problem)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package kratos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+var (
+	// ErrMissingTransactionUUID is returned by SendWithResponse when the message
+	// has no TransactionUUID to pair the server's response with
+	ErrMissingTransactionUUID = errors.New("message has no transaction uuid")
+
+	// ErrDuplicateTransaction is returned by SendWithResponse when another call
+	// is already waiting on a response for the same TransactionUUID
+	ErrDuplicateTransaction = errors.New("a request with this transaction uuid is already in flight")
+
+	// ErrReconnected is returned by SendWithResponse when the connection the
+	// request was sent on was lost before the response arrived
+	ErrReconnected = errors.New("connection was lost while waiting on the response")
+
+	// ErrNotConfirmed is returned by SendConfirmed when the server answered
+	// with a status that isn't a success
+	ErrNotConfirmed = errors.New("message wasn't confirmed by the server")
+
+	// ErrTooManyInflight is returned by SendWithResponse when
+	// MaxInflightRequests calls are already waiting on a response and
+	// RejectWhenInflightFull is set
+	ErrTooManyInflight = errors.New("too many requests in flight")
+)
+
+// RequestOption changes how a single SendWithResponse call behaves
+type RequestOption func(*transaction)
+
+// Idempotent marks a request as safe to send more than once, so that it is
+// sent again on the new connection after a reconnect instead of failing
+// with ErrReconnected.
+func Idempotent() RequestOption {
+	return func(t *transaction) {
+		t.idempotent = true
+	}
+}
+
+// transaction is a SendWithResponse call waiting on the server's response
+type transaction struct {
+	message    wrp.Message
+	idempotent bool
+	response   chan wrp.Message
+	failed     chan error
+}
+
+// SendWithResponse sends message and blocks until the server answers with a
+// response, such as a SimpleRequestResponse, carrying the same TransactionUUID
+// or until ctx is done. The response is handed straight back to the caller and
+// never reaches the registered handlers.
+//
+// If the connection is lost while waiting, the call fails right away with
+// ErrReconnected since the response can't arrive on the new connection,
+// unless the request was made with the Idempotent option, in which case it
+// is sent again once the client has reconnected. It fails with ErrReconnected
+// all the same when the client can't reconnect, and with ErrClientClosed
+// once the client is closed.
+//
+// With MaxInflightRequests set, a call beyond it waits for another to end, up
+// to ctx, or fails with ErrTooManyInflight when RejectWhenInflightFull is set.
+func (c *client) SendWithResponse(ctx context.Context, message wrp.Message, options ...RequestOption) (wrp.Message, error) {
+	if c.factory.ReadOnly {
+		return wrp.Message{}, ErrReadOnly
+	}
+
+	if message.TransactionUUID == "" {
+		return wrp.Message{}, ErrMissingTransactionUUID
+	}
+
+	if c.inflightSlots != nil {
+		if c.factory.RejectWhenInflightFull {
+			select {
+			case c.inflightSlots <- struct{}{}:
+			default:
+				return wrp.Message{}, ErrTooManyInflight
+			}
+		} else {
+			select {
+			case c.inflightSlots <- struct{}{}:
+			case <-ctx.Done():
+				return wrp.Message{}, ctx.Err()
+			}
+		}
+		defer func() { <-c.inflightSlots }()
+	}
+
+	t := &transaction{
+		message:  message,
+		response: make(chan wrp.Message, 1),
+		failed:   make(chan error, 1),
+	}
+
+	for _, o := range options {
+		o(t)
+	}
+
+	c.transactionsLock.Lock()
+	if _, ok := c.transactions[message.TransactionUUID]; ok {
+		c.transactionsLock.Unlock()
+		return wrp.Message{}, ErrDuplicateTransaction
+	}
+	c.transactions[message.TransactionUUID] = t
+	c.transactionsLock.Unlock()
+
+	// only this call's entry is removed, however it ends, so that canceling
+	// one request leaves the others waiting
+	defer func() {
+		c.transactionsLock.Lock()
+		if c.transactions[message.TransactionUUID] == t {
+			delete(c.transactions, message.TransactionUUID)
+		}
+		c.transactionsLock.Unlock()
+	}()
+
+	if err := c.Send(message); err != nil {
+		return wrp.Message{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return wrp.Message{}, ctx.Err()
+	case <-c.shutdown:
+		return wrp.Message{}, ErrClientClosed
+	case err := <-t.failed:
+		return wrp.Message{}, err
+	case msg := <-t.response:
+		return msg, nil
+	}
+}
+
+// failTransactions is called when the connection is lost and fails every
+// request that can't be sent again
+func (c *client) failTransactions() {
+	c.transactionsLock.RLock()
+	defer c.transactionsLock.RUnlock()
+
+	for _, t := range c.transactions {
+		if !t.idempotent {
+			t.fail(ErrReconnected)
+		}
+	}
+}
+
+// abandonTransactions fails every request still waiting with err, the
+// idempotent ones included, once there won't be a connection to send them
+// again on
+func (c *client) abandonTransactions(err error) {
+	c.transactionsLock.RLock()
+	defer c.transactionsLock.RUnlock()
+
+	for _, t := range c.transactions {
+		t.fail(err)
+	}
+}
+
+// resendTransactions sends the idempotent requests still waiting on a response
+// again over the new connection
+func (c *client) resendTransactions() {
+	c.transactionsLock.RLock()
+	var resend []*transaction
+	for _, t := range c.transactions {
+		if t.idempotent {
+			resend = append(resend, t)
+		}
+	}
+	c.transactionsLock.RUnlock()
+
+	for _, t := range resend {
+		if err := c.Send(t.message); err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+func (t *transaction) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
+func (c *client) InflightRequests() int {
+	c.transactionsLock.RLock()
+	defer c.transactionsLock.RUnlock()
+	return len(c.transactions)
+}
+
+// OnAck registers fn to be called once, the first time a message carrying
+// transactionUUID is received. Unlike SendWithResponse it doesn't block and
+// the message is still dispatched to the handlers afterwards. Registering
+// again for the same uuid replaces the previous callback and a nil fn
+// removes it.
+func (c *client) OnAck(transactionUUID string, fn func()) {
+	c.transactionsLock.Lock()
+	defer c.transactionsLock.Unlock()
+
+	if fn == nil {
+		delete(c.acks, transactionUUID)
+		return
+	}
+
+	if c.acks == nil {
+		c.acks = make(map[string]func())
+	}
+	c.acks[transactionUUID] = fn
+}
+
+// acknowledge calls and removes the OnAck callback registered for the
+// TransactionUUID of msg, if there is one
+func (c *client) acknowledge(msg wrp.Message) {
+	if msg.TransactionUUID == "" {
+		return
+	}
+
+	c.transactionsLock.Lock()
+	fn, ok := c.acks[msg.TransactionUUID]
+	delete(c.acks, msg.TransactionUUID)
+	c.transactionsLock.Unlock()
+
+	if ok {
+		fn()
+	}
+}
+
+// completeTransaction hands msg to the SendWithResponse call waiting on its
+// TransactionUUID, if there is one and msg is a response, and reports whether
+// it did so
+func (c *client) completeTransaction(msg wrp.Message) bool {
+	if msg.TransactionUUID == "" || !isResponseType(msg.Type) {
+		return false
+	}
+
+	c.transactionsLock.RLock()
+	t, ok := c.transactions[msg.TransactionUUID]
+	c.transactionsLock.RUnlock()
+
+	if ok {
+		select {
+		case t.response <- msg:
+		default:
+		}
+	}
+
+	return ok
+}
+
+// isResponseType tells whether a message of this type can answer a request.
+// Anything else, like an event that happens to carry a transaction uuid, goes
+// through the normal handler dispatch.
+func isResponseType(messageType wrp.MessageType) bool {
+	switch messageType {
+	case wrp.SimpleRequestResponseMessageType,
+		wrp.CreateMessageType,
+		wrp.RetrieveMessageType,
+		wrp.UpdateMessageType,
+		wrp.DeleteMessageType:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendConfirmed sends message and waits for the server to confirm that it
+// processed it, answering with a response carrying the same TransactionUUID
+// and a success status, or no status at all. Send on the other hand returns
+// as soon as the message is written, not knowing what became of it.
+//
+// A response with any other status fails with ErrNotConfirmed. Otherwise the
+// errors are those of SendWithResponse, which SendConfirmed is built on.
+func (c *client) SendConfirmed(ctx context.Context, message wrp.Message, options ...RequestOption) error {
+	response, err := c.SendWithResponse(ctx, message, options...)
+	if err != nil {
+		return err
+	}
+
+	if status := response.Status; status != nil && (*status < 200 || *status > 299) {
+		return fmt.Errorf("%w: status %d", ErrNotConfirmed, *status)
+	}
+	return nil
+}
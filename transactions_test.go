@@ -0,0 +1,363 @@
+package kratos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func newTransactionTestClient(fakeConn *mockConnection) *client {
+	return &client{
+		connection:   fakeConn,
+		Logger:       logging.New(nil),
+		transactions: make(map[string]*transaction),
+	}
+}
+
+// test the happy path of a request whose response is routed back to the caller
+func TestSendWithResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := newTransactionTestClient(fakeConn)
+
+	go func() {
+		for testClient.InflightRequests() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		testClient.completeTransaction(wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			TransactionUUID: "emu:unique",
+			Payload:         []byte("right back at you"),
+		})
+	}()
+
+	response, err := testClient.SendWithResponse(context.Background(), wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          "mac:ffffff112233/emu",
+		Destination:     "/bar",
+		TransactionUUID: "emu:unique",
+	})
+
+	assert.Nil(err)
+	assert.Equal([]byte("right back at you"), response.Payload)
+	assert.Equal(0, testClient.InflightRequests())
+	fakeConn.AssertExpectations(t)
+}
+
+func TestSendWithResponseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := newTransactionTestClient(fakeConn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := testClient.SendWithResponse(ctx, wrp.Message{TransactionUUID: "emu:unique"})
+
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(0, testClient.InflightRequests())
+	fakeConn.AssertExpectations(t)
+}
+
+// test that the calls beyond MaxInflightRequests wait, or fail when rejected
+func TestMaxInflightRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := newTransactionTestClient(fakeConn)
+	testClient.inflightSlots = make(chan struct{}, 1)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:first"})
+		first <- err
+	}()
+
+	for testClient.InflightRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := testClient.SendWithResponse(ctx, wrp.Message{TransactionUUID: "emu:second"})
+	assert.Equal(context.DeadlineExceeded, err)
+
+	testClient.factory.RejectWhenInflightFull = true
+	_, err = testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:third"})
+	assert.Equal(ErrTooManyInflight, err)
+
+	testClient.completeTransaction(wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "emu:first"})
+	assert.Nil(<-first)
+	assert.Len(testClient.inflightSlots, 0)
+	fakeConn.AssertExpectations(t)
+}
+
+func TestSendWithResponseMissingUUID(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := newTransactionTestClient(&mockConnection{})
+	_, err := testClient.SendWithResponse(context.Background(), wrp.Message{})
+
+	assert.Equal(ErrMissingTransactionUUID, err)
+}
+
+func TestOnAck(t *testing.T) {
+	assert := assert.New(t)
+
+	testClient := newTransactionTestClient(&mockConnection{})
+
+	acked := 0
+	testClient.OnAck("emu:unique", func() { acked++ })
+	testClient.OnAck("emu:removed", func() { acked += 100 })
+	testClient.OnAck("emu:removed", nil)
+
+	testClient.acknowledge(wrp.Message{TransactionUUID: "emu:other"})
+	testClient.acknowledge(wrp.Message{TransactionUUID: "emu:removed"})
+	assert.Equal(0, acked)
+
+	testClient.acknowledge(wrp.Message{TransactionUUID: "emu:unique"})
+	testClient.acknowledge(wrp.Message{TransactionUUID: "emu:unique"})
+	assert.Equal(1, acked)
+}
+
+func TestSendWithResponseReconnected(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Times(3)
+
+	testClient := newTransactionTestClient(fakeConn)
+
+	results := make(chan error, 2)
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:lost"})
+		results <- err
+	}()
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:resent"}, Idempotent())
+		results <- err
+	}()
+
+	for testClient.InflightRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	testClient.failTransactions()
+	assert.Equal(ErrReconnected, <-results)
+
+	// the idempotent request is still waiting and goes out again
+	testClient.resendTransactions()
+	testClient.completeTransaction(wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "emu:resent"})
+	assert.Nil(<-results)
+	fakeConn.AssertExpectations(t)
+}
+
+// test that closing the client fails every request still waiting, the
+// idempotent ones included
+func TestSendWithResponseClosed(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Twice()
+	fakeConn.On("Close").Return(nil).Once()
+
+	testClient := newTransactionTestClient(fakeConn)
+	testClient.shutdown = make(chan struct{})
+
+	results := make(chan error, 2)
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:plain"})
+		results <- err
+	}()
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:idempotent"}, Idempotent())
+		results <- err
+	}()
+
+	for testClient.InflightRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Nil(testClient.Close())
+	assert.Equal(ErrClientClosed, <-results)
+	assert.Equal(ErrClientClosed, <-results)
+	fakeConn.AssertExpectations(t)
+}
+
+// test that an idempotent request doesn't wait for a new connection when the
+// client can't reconnect
+func TestSendWithResponseNotReconnected(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	// without a DestinationURL there is nowhere to reconnect to
+	testClient := newTransactionTestClient(fakeConn)
+	testClient.shutdown = make(chan struct{})
+
+	results := make(chan error, 1)
+	go func() {
+		_, err := testClient.SendWithResponse(context.Background(), wrp.Message{TransactionUUID: "emu:resent"}, Idempotent())
+		results <- err
+	}()
+
+	for testClient.InflightRequests() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	testClient.redial(ReconnectServerClose, "1012", 0)
+	assert.Equal(ErrReconnected, <-results)
+	fakeConn.AssertExpectations(t)
+}
+
+// test that only responses complete a request, anything else carrying the same
+// transaction uuid is left to the handlers
+func TestCompleteTransactionResponseTypes(t *testing.T) {
+	tests := []struct {
+		messageType wrp.MessageType
+		completed   bool
+	}{
+		{wrp.SimpleRequestResponseMessageType, true},
+		{wrp.RetrieveMessageType, true},
+		{wrp.SimpleEventMessageType, false},
+		{wrp.ServiceAliveMessageType, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.messageType.String(), func(t *testing.T) {
+			assert := assert.New(t)
+
+			testClient := newTransactionTestClient(&mockConnection{})
+			testClient.transactions["emu:unique"] = &transaction{response: make(chan wrp.Message, 1)}
+
+			assert.Equal(tc.completed, testClient.completeTransaction(wrp.Message{
+				Type:            tc.messageType,
+				TransactionUUID: "emu:unique",
+			}))
+		})
+	}
+}
+
+// test that canceling one of several requests unblocks only that one
+func TestSendWithResponseCancelOne(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Times(3)
+
+	testClient := newTransactionTestClient(fakeConn)
+
+	type result struct {
+		uuid string
+		msg  wrp.Message
+		err  error
+	}
+
+	results := make(chan result, 3)
+	canceledCtx, cancel := context.WithCancel(context.Background())
+
+	for _, uuid := range []string{"emu:first", "emu:canceled", "emu:last"} {
+		ctx := context.Background()
+		if uuid == "emu:canceled" {
+			ctx = canceledCtx
+		}
+
+		go func(ctx context.Context, uuid string) {
+			msg, err := testClient.SendWithResponse(ctx, wrp.Message{
+				Type:            wrp.SimpleRequestResponseMessageType,
+				TransactionUUID: uuid,
+			})
+			results <- result{uuid, msg, err}
+		}(ctx, uuid)
+	}
+
+	for testClient.InflightRequests() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	canceled := <-results
+	assert.Equal("emu:canceled", canceled.uuid)
+	assert.Equal(context.Canceled, canceled.err)
+	assert.Equal(2, testClient.InflightRequests())
+
+	for _, uuid := range []string{"emu:first", "emu:last"} {
+		assert.True(testClient.completeTransaction(wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			TransactionUUID: uuid,
+			Payload:         []byte(uuid),
+		}))
+	}
+
+	for i := 0; i < 2; i++ {
+		completed := <-results
+		assert.Nil(completed.err)
+		assert.Equal([]byte(completed.uuid), completed.msg.Payload)
+	}
+
+	assert.Equal(0, testClient.InflightRequests())
+	fakeConn.AssertExpectations(t)
+}
+
+func TestSendConfirmed(t *testing.T) {
+	accepted, rejected := int64(202), int64(500)
+	tests := []struct {
+		description string
+		status      *int64
+		confirmed   bool
+	}{
+		{"no status", nil, true},
+		{"success", &accepted, true},
+		{"failure", &rejected, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fakeConn := &mockConnection{}
+			fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+			testClient := newTransactionTestClient(fakeConn)
+
+			go func() {
+				for testClient.InflightRequests() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				testClient.completeTransaction(wrp.Message{
+					Type:            wrp.SimpleRequestResponseMessageType,
+					TransactionUUID: "emu:unique",
+					Status:          tc.status,
+				})
+			}()
+
+			err := testClient.SendConfirmed(context.Background(), wrp.Message{
+				Type:            wrp.SimpleRequestResponseMessageType,
+				TransactionUUID: "emu:unique",
+			})
+
+			if tc.confirmed {
+				assert.Nil(err)
+			} else {
+				assert.True(errors.Is(err, ErrNotConfirmed))
+			}
+			fakeConn.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package kratos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// ErrInvalidMessage is returned by Send, when ValidateOutbound is set, for a
+// message missing fields its type requires
+var ErrInvalidMessage = errors.New("invalid WRP message")
+
+// authorizationMessageType is the type of the WRP authorization status
+// message, which this version of wrp-go doesn't declare
+const authorizationMessageType wrp.MessageType = 2
+
+// validateMessage checks that msg has the fields required by its type and
+// reports every one that is missing
+func validateMessage(msg *wrp.Message) error {
+	var problems []string
+	require := func(ok bool, field string) {
+		if !ok {
+			problems = append(problems, field+" is required")
+		}
+	}
+
+	switch msg.Type {
+	case wrp.SimpleRequestResponseMessageType,
+		wrp.CreateMessageType,
+		wrp.RetrieveMessageType,
+		wrp.UpdateMessageType,
+		wrp.DeleteMessageType:
+		require(msg.Source != "", "source")
+		require(msg.Destination != "", "dest")
+		require(msg.TransactionUUID != "", "transaction_uuid")
+	case wrp.SimpleEventMessageType:
+		require(msg.Source != "", "source")
+		require(msg.Destination != "", "dest")
+	case authorizationMessageType:
+		require(msg.Status != nil, "status")
+	case wrp.ServiceRegistrationMessageType:
+		require(msg.ServiceName != "", "service_name")
+		require(msg.URL != "", "url")
+	case wrp.ServiceAliveMessageType:
+	default:
+		problems = append(problems, fmt.Sprintf("msg_type %d is not a valid message type", msg.Type))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// validateEncoded decodes what Send is about to write and validates it, which
+// works the same whatever type of message Send was given. The fields required
+// by its type are only checked when required is set, those of version always
+// are.
+func validateEncoded(encoded []byte, required bool, version WRPVersion) error {
+	var msg wrp.Message
+	if err := wrp.NewDecoderBytes(encoded, wrp.Msgpack).Decode(&msg); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+
+	if required {
+		if err := validateMessage(&msg); err != nil {
+			return err
+		}
+	}
+	return validateVersion(&msg, version)
+}
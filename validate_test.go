@@ -0,0 +1,66 @@
+package kratos
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestValidateMessage(t *testing.T) {
+	status := int64(200)
+
+	tests := []struct {
+		description string
+		msg         wrp.Message
+		problems    string
+	}{
+		{"request", wrp.Message{Type: wrp.SimpleRequestResponseMessageType, Source: "mac:ffffff112233", Destination: "/bar", TransactionUUID: "emu:unique"}, ""},
+		{"request missing fields", wrp.Message{Type: wrp.RetrieveMessageType, Destination: "/bar"}, "source is required, transaction_uuid is required"},
+		{"event", wrp.Message{Type: wrp.SimpleEventMessageType, Source: "mac:ffffff112233", Destination: "event:test"}, ""},
+		{"event missing destination", wrp.Message{Type: wrp.SimpleEventMessageType, Source: "mac:ffffff112233"}, "dest is required"},
+		{"authorization", wrp.Message{Type: authorizationMessageType, Status: &status}, ""},
+		{"registration", wrp.Message{Type: wrp.ServiceRegistrationMessageType, ServiceName: "config"}, "url is required"},
+		{"no type", wrp.Message{Source: "mac:ffffff112233", Destination: "/bar"}, "msg_type 0 is not a valid message type"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := validateMessage(&tc.msg)
+			if tc.problems == "" {
+				assert.Nil(err)
+				return
+			}
+
+			assert.True(errors.Is(err, ErrInvalidMessage))
+			assert.Contains(err.Error(), tc.problems)
+		})
+	}
+}
+
+// test that an invalid message is never written
+func TestSendValidateOutbound(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	fakeConn.On("WriteMessage", websocket.BinaryMessage, mock.AnythingOfType("[]uint8")).Return(nil).Once()
+
+	testClient := &client{
+		deviceID:   "mac:ffffff112233",
+		connection: fakeConn,
+		factory:    ClientFactory{ValidateOutbound: true},
+		Logger:     logging.New(nil),
+	}
+
+	err := testClient.Send(wrp.SimpleRequestResponse{Source: "mac:ffffff112233", Destination: "/bar"})
+	assert.True(errors.Is(err, ErrInvalidMessage))
+
+	assert.Nil(testClient.SendEvent("event:test", nil))
+	fakeConn.AssertExpectations(t)
+}
@@ -0,0 +1,46 @@
+package kratos
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultConnectTimeout is how long VerifyOnConnect waits for the pong when
+// ConnectTimeout isn't set
+const defaultConnectTimeout = 10 * time.Second
+
+// ErrConnectionNotVerified is returned by New when VerifyOnConnect is set and
+// the pong of the verification ping didn't come back in time
+var ErrConnectionNotVerified = errors.New("no pong received on the new connection")
+
+func (f *ClientFactory) connectTimeout() time.Duration {
+	if f.ConnectTimeout > 0 {
+		return f.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// verifyConnection sends a ping on the connection of pmh and waits for its
+// pong, up to ConnectTimeout or until ctx is done
+func (c *client) verifyConnection(ctx context.Context, pmh *pingHandler) error {
+	pong := make(chan struct{})
+	if err := pmh.sendPing(c, pong); err != nil {
+		return err
+	}
+
+	timer := c.clock().NewTimer(c.factory.connectTimeout())
+	defer timer.Stop()
+
+	select {
+	case <-pong:
+		return nil
+	case <-pmh.readDone:
+		// the connection was lost before the pong could be read
+		return ErrConnectionNotVerified
+	case <-timer.C():
+		return ErrConnectionNotVerified
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package kratos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+// test that New only returns a client once a ping made the round trip
+func TestVerifyOnConnect(t *testing.T) {
+	tests := []struct {
+		description string
+		answer      bool
+		expected    error
+	}{
+		{"pong", true, nil},
+		{"half open", false, ErrConnectionNotVerified},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				if !tc.answer {
+					// pings are only answered while reading
+					<-release
+					return
+				}
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}))
+			defer backend.Close()
+			defer close(release)
+
+			petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, backend.URL, http.StatusTemporaryRedirect)
+			}))
+			defer petasos.Close()
+
+			factory := &ClientFactory{
+				DeviceName:      "mac:ffffff112233",
+				DestinationURL:  petasos.URL,
+				ClientLogger:    logging.New(nil),
+				VerifyOnConnect: true,
+				ConnectTimeout:  200 * time.Millisecond,
+			}
+
+			testClient, err := factory.New()
+			assert.Equal(tc.expected, err)
+			if testClient != nil {
+				testClient.Close()
+			}
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(defaultConnectTimeout, (&ClientFactory{}).connectTimeout())
+	assert.Equal(time.Second, (&ClientFactory{ConnectTimeout: time.Second}).connectTimeout())
+}
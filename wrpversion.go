@@ -0,0 +1,74 @@
+package kratos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+// ErrUnsupportedWRPVersion is returned by New for a WRPVersion that isn't
+// one of those below
+var ErrUnsupportedWRPVersion = errors.New("unsupported WRP version")
+
+// WRPVersion is the version of the WRP message schema the server expects,
+// which decides the fields the client sends and reads
+type WRPVersion int
+
+const (
+	// WRPVersion1 messages only have the fields of the original schema:
+	// msg_type, source, dest, transaction_uuid, content_type, accept,
+	// status, rdr, headers, spans, path and payload, along with service_name
+	// and url for service registrations. Sending a message with any other
+	// field fails with ErrInvalidMessage, and those fields are left out of
+	// the messages read.
+	WRPVersion1 WRPVersion = 1
+
+	// WRPVersion2 adds metadata, include_spans and partner_ids. It's the
+	// default.
+	WRPVersion2 WRPVersion = 2
+)
+
+// wrpVersion returns the WRPVersion in use, WRPVersion2 when unset
+func (f *ClientFactory) wrpVersion() WRPVersion {
+	if f.WRPVersion == 0 {
+		return WRPVersion2
+	}
+	return f.WRPVersion
+}
+
+// validateVersion checks that a message sent with version has none of the
+// fields the version doesn't have, reporting every one found
+func validateVersion(msg *wrp.Message, version WRPVersion) error {
+	if version != WRPVersion1 {
+		return nil
+	}
+
+	var problems []string
+	forbid := func(set bool, field string) {
+		if set {
+			problems = append(problems, field+" is not part of WRP version 1")
+		}
+	}
+
+	forbid(len(msg.Metadata) > 0, "metadata")
+	forbid(msg.IncludeSpans != nil, "include_spans")
+	forbid(len(msg.PartnerIDs) > 0, "partner_ids")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// stripVersion clears the fields of a message read that version doesn't have
+func stripVersion(msg *wrp.Message, version WRPVersion) {
+	if version != WRPVersion1 {
+		return
+	}
+
+	msg.Metadata = nil
+	msg.IncludeSpans = nil
+	msg.PartnerIDs = nil
+}
@@ -0,0 +1,56 @@
+package kratos
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/wrp"
+)
+
+func TestValidateVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	includeSpans := true
+	msg := wrp.Message{
+		Type:         wrp.SimpleEventMessageType,
+		Source:       "mac:ffffff112233",
+		Destination:  "event:test",
+		Metadata:     map[string]string{"/boot-time": "1500000000"},
+		IncludeSpans: &includeSpans,
+		PartnerIDs:   []string{"comcast"},
+	}
+
+	assert.Nil(validateVersion(&msg, WRPVersion2))
+
+	err := validateVersion(&msg, WRPVersion1)
+	assert.True(errors.Is(err, ErrInvalidMessage))
+	assert.Contains(err.Error(), "metadata is not part of WRP version 1, include_spans is not part of WRP version 1, partner_ids is not part of WRP version 1")
+
+	stripVersion(&msg, WRPVersion1)
+	assert.Nil(validateVersion(&msg, WRPVersion1))
+	assert.Equal("event:test", msg.Destination)
+}
+
+// test that a client using WRPVersion1 refuses to send what the version lacks
+func TestWRPVersion1(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeConn := &mockConnection{}
+	testClient := &client{
+		connection: fakeConn,
+		Logger:     logging.New(nil),
+		factory:    ClientFactory{WRPVersion: WRPVersion1},
+	}
+
+	err := testClient.Send(wrp.SimpleEvent{Destination: "event:test", PartnerIDs: []string{"comcast"}})
+	assert.True(errors.Is(err, ErrInvalidMessage))
+	fakeConn.AssertExpectations(t)
+
+	msg := testClient.NewMessage().To("mac:ffffff112233/config").Partner("comcast").Build()
+	assert.Empty(msg.PartnerIDs)
+
+	_, err = (&ClientFactory{DeviceName: "mac:ffffff112233", WRPVersion: 3}).newClient()
+	assert.True(errors.Is(err, ErrUnsupportedWRPVersion))
+}